@@ -1,3 +1,5 @@
 module src.acicovic.me/koipond
 
 go 1.22.4
+
+require golang.org/x/crypto v0.31.0
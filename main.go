@@ -1,7 +1,11 @@
 package main
 
-import "src.acicovic.me/koipond/server"
+import (
+	"os"
+
+	"src.acicovic.me/koipond/server"
+)
 
 func main() {
-	server.Run()
+	os.Exit(server.Run())
 }
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ItemObject is the JSON representation of an item.
+type ItemObject struct {
+	ID          int               `json:"id"`
+	Type        string            `json:"type"`
+	Label       string            `json:"label"`
+	Visibility  string            `json:"visibility"`
+	Tags        []string          `json:"tags"`
+	Collections []string          `json:"collections"`
+	Metadata    map[string]string `json:"metadata"`
+	Revision    string            `json:"revision"`
+}
+
+// itemObject converts the item to its JSON representation, leaving out
+// collections that are not accessible to the audience of the view.
+func (v *View) itemObject(item *Item) *ItemObject {
+	object := &ItemObject{
+		ID:          item.ID,
+		Type:        item.Type,
+		Label:       item.Label,
+		Visibility:  item.Visibility.String(),
+		Tags:        item.Tags(),
+		Collections: v.itemCollections(item),
+		Metadata:    make(map[string]string, len(item.Metadata)),
+		Revision:    item.Revision,
+	}
+	if object.Tags == nil {
+		object.Tags = []string{}
+	}
+	for key, value := range item.Metadata {
+		object.Metadata[key] = value
+	}
+	if len(object.Collections) > 0 {
+		object.Metadata[MKEY_COLLECTIONS] = strings.Join(object.Collections, ",")
+	} else {
+		delete(object.Metadata, MKEY_COLLECTIONS)
+	}
+	return object
+}
+
+// itemCollections returns keys of the item's collections accessible to the audience.
+func (v *View) itemCollections(item *Item) []string {
+	collections := []string{}
+	if item.Metadata[MKEY_COLLECTIONS] == "" {
+		return collections
+	}
+	for _, key := range strings.Split(item.Metadata[MKEY_COLLECTIONS], ",") {
+		if v.db.collectionVisibility[key].accessibleTo(v.audience) {
+			collections = append(collections, key)
+		}
+	}
+	return collections
+}
+
+func serveAPIItems(w http.ResponseWriter, r *http.Request) {
+	view := currentDatabase().view(audienceOf(r))
+	serveAPICached(w, r, view, func() any {
+		items := []*ItemObject{}
+		for _, item := range view.listed(view.db.items) {
+			items = append(items, view.itemObject(item))
+		}
+		return items
+	})
+}
+
+func serveAPIItem(w http.ResponseWriter, r *http.Request) {
+	view := currentDatabase().view(audienceOf(r))
+	itemID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "Item not found.")
+		return
+	}
+	if redirectToCanonicalItem(w, r, itemID) {
+		return
+	}
+	item := view.singleItem(itemID)
+	if item == nil {
+		writeJSONError(w, http.StatusNotFound, "Item not found.")
+		return
+	}
+	w.Header().Set("ETag", etag(item.Revision))
+	serveAPICached(w, r, view, func() any {
+		return view.itemObject(item)
+	})
+}
+
+// handleAPIItemUpdate replaces the metadata of an item, but only if the If-Match
+// header holds its current revision, as sent in the ETag header of its GET response,
+// so that changes made in the meantime are not overwritten. Metadata values equal
+// to defaults of the item type are left out, since GET responses include them.
+func handleAPIItemUpdate(w http.ResponseWriter, r *http.Request) {
+	db := currentDatabase()
+	view := db.view(audienceOf(r))
+	itemID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "Item not found.")
+		return
+	}
+	item := view.singleItem(itemID)
+	if item == nil {
+		writeJSONError(w, http.StatusNotFound, "Item not found.")
+		return
+	}
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		writeJSONError(w, http.StatusPreconditionRequired, "If-Match header with the item revision required.")
+		return
+	}
+
+	var body struct {
+		Metadata map[string]string `json:"metadata"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Metadata == nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid body, expected an object with metadata.")
+		return
+	}
+	if !matchesETag(ifMatch, item.Revision) {
+		revision := strings.Trim(strings.TrimSpace(ifMatch), `"`)
+		writeJSON(w, http.StatusPreconditionFailed, &ItemConflict{
+			Error:    "The item was changed in the meantime.",
+			Revision: item.Revision,
+			Item:     view.itemObject(item),
+			Changes:  changesSince(db, item, revision),
+		})
+		return
+	}
+	for key, value := range body.Metadata {
+		if defaultValue, found := db.defaults[item.Type+"/"+key]; found && value == defaultValue {
+			delete(body.Metadata, key)
+		}
+	}
+
+	updated, err := updateItem(db, item.ID, body.Metadata, requestUser(r), 0)
+	switch {
+	case errors.Is(err, errStoreChanged):
+		writeJSONError(w, http.StatusConflict, "The store file was changed in the meantime, try again.")
+		return
+	case errors.Is(err, errItemNotFound):
+		writeJSONError(w, http.StatusNotFound, "Item not found.")
+		return
+	case errors.As(err, &errInvalidItem{}):
+		writeJSONError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Invalid metadata: %v.", err))
+		return
+	case err != nil:
+		traceError(_https, "update item %d: %v", item.ID, err)
+		writeJSONError(w, http.StatusInternalServerError, "Internal server error.")
+		return
+	}
+	trace(_https, "user %q updated item %d", requestUser(r), item.ID)
+	item = updated.view(audienceOf(r)).singleItem(item.ID)
+	w.Header().Set("ETag", etag(item.Revision))
+	writeJSON(w, http.StatusOK, updated.view(audienceOf(r)).itemObject(item))
+}
+
+func serveAPICollections(w http.ResponseWriter, r *http.Request) {
+	view := currentDatabase().view(audienceOf(r))
+	serveAPICached(w, r, view, func() any {
+		type collection struct {
+			Key        string `json:"key"`
+			Name       string `json:"name"`
+			Visibility string `json:"visibility"`
+			Items      int    `json:"items"`
+		}
+		collections := []collection{}
+		for key, name := range view.collections() {
+			collections = append(collections, collection{
+				Key:        key,
+				Name:       name,
+				Visibility: view.db.collectionVisibility[key].String(),
+				Items:      len(view.listed(view.db.collectioned[key])),
+			})
+		}
+		sort.Slice(collections, func(i, j int) bool { return collections[i].Key < collections[j].Key })
+		return collections
+	})
+}
+
+func serveAPITags(w http.ResponseWriter, r *http.Request) {
+	view := currentDatabase().view(audienceOf(r))
+	serveAPICached(w, r, view, func() any {
+		return view.tags()
+	})
+}
+
+// serveAPICached encodes the object built by the function only if it was not
+// already encoded for the request path using the same Database instance and
+// audience, see renderCached.
+func serveAPICached(w http.ResponseWriter, r *http.Request, view *View, build func() any) {
+	content, found := view.cachedPage(r.URL.Path)
+	if !found {
+		var err error
+		if content, err = json.MarshalIndent(build(), "", "  "); err != nil {
+			traceError(_https, "encode JSON: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Internal server error.")
+			return
+		}
+		content = append(content, '\n')
+		view.cachePage(r.URL.Path, content)
+	}
+	serveVersioned(w, r, view, "application/json", content)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
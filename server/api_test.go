@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const TEST_STORE = `<koidatabase created="2024-01-01" lastModified="2024-01-01">
+  <koitypes enabled="books">
+    <metadata key="books/lang" default="English"/>
+  </koitypes>
+  <collections/>
+  <data>
+    <books>
+      <book title="The Hobbit" author="J. R. R. Tolkien" tags="fantasy"/>
+      <book title="Dune" author="Frank Herbert" visibility="private"/>
+    </books>
+  </data>
+</koidatabase>
+`
+
+// testStore writes TEST_STORE to a temporary directory, and loads it as the
+// current Database.
+func testStore(t *testing.T) *Database {
+	t.Helper()
+	_logger = newLogger(io.Discard, LOG_FORMAT_TEXT, slog.LevelError)
+	path := filepath.Join(t.TempDir(), "koidata.xml")
+	if err := os.WriteFile(path, []byte(TEST_STORE), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := loadDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_database.Store(db)
+	return db
+}
+
+// serveTest serves the request through the handler registered for the pattern.
+func serveTest(handler http.HandlerFunc, pattern string, r *http.Request) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc(pattern, handler)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+// putItem sends the metadata to PUT /api/v1/items/0 with the If-Match header, if set.
+func putItem(metadata map[string]string, ifMatch string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]any{"metadata": metadata})
+	r := httptest.NewRequest(http.MethodPut, "/api/v1/items/0", strings.NewReader(string(body)))
+	if ifMatch != "" {
+		r.Header.Set("If-Match", ifMatch)
+	}
+	return serveTest(handleAPIItemUpdate, "PUT /api/v1/items/{id}", r)
+}
+
+func TestItemETag(t *testing.T) {
+	testStore(t)
+
+	w := serveTest(serveAPIItem, "GET /api/v1/items/{id}", httptest.NewRequest(http.MethodGet, "/api/v1/items/0", nil))
+	var item ItemObject
+	if err := json.Unmarshal(w.Body.Bytes(), &item); err != nil {
+		t.Fatal(err)
+	}
+	tag := w.Header().Get("ETag")
+	if tag != `"`+item.Revision+`"` {
+		t.Fatalf("ETag %s, want the revision %q as a strong entity tag", tag, item.Revision)
+	}
+
+	item.Metadata["author"] = "Tolkien"
+	if w := putItem(item.Metadata, ""); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("without If-Match: status %d, want 428", w.Code)
+	}
+	w = putItem(item.Metadata, tag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("with the ETag in If-Match: status %d, want 200: %s", w.Code, w.Body)
+	}
+	if updated := w.Header().Get("ETag"); updated == tag || updated == "" {
+		t.Errorf("ETag after the update %s, want a new revision", updated)
+	}
+	if w := putItem(item.Metadata, tag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("with the outdated ETag in If-Match: status %d, want 412", w.Code)
+	}
+}
+
+func TestItemReservedKeys(t *testing.T) {
+	testStore(t)
+	get := func() ItemObject {
+		t.Helper()
+		w := serveTest(serveAPIItem, "GET /api/v1/items/{id}", httptest.NewRequest(http.MethodGet, "/api/v1/items/0", nil))
+		var item ItemObject
+		if err := json.Unmarshal(w.Body.Bytes(), &item); err != nil {
+			t.Fatal(err)
+		}
+		return item
+	}
+
+	// the first update assigns a uid
+	item := get()
+	if w := putItem(item.Metadata, etag(item.Revision)); w.Code != http.StatusOK {
+		t.Fatalf("update: status %d, want 200: %s", w.Code, w.Body)
+	}
+	item = get()
+	uid := item.Metadata[MKEY_UID]
+	if uid == "" {
+		t.Fatal("no uid assigned")
+	}
+	version := currentDatabase().version
+
+	for key, value := range map[string]string{MKEY_UID: "other", MKEY_DELETED: "2024-01-01T00:00:00Z"} {
+		metadata := maps.Clone(item.Metadata)
+		metadata[key] = value
+		if w := putItem(metadata, etag(item.Revision)); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("with %s: status %d, want 422", key, w.Code)
+		}
+	}
+	if current := currentDatabase(); current.version != version || current.items[0].Metadata[MKEY_DELETED] != "" {
+		t.Error("rejected updates changed the store")
+	}
+
+	item.Metadata["author"] = "Tolkien"
+	if w := putItem(item.Metadata, etag(item.Revision)); w.Code != http.StatusOK {
+		t.Fatalf("with the same uid: status %d, want 200: %s", w.Code, w.Body)
+	}
+	if got := get().Metadata[MKEY_UID]; got != uid {
+		t.Errorf("uid %q after the update, want %q", got, uid)
+	}
+}
@@ -0,0 +1,435 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cookie names.
+const (
+	COOKIE_SESSION = "koi_session"
+	COOKIE_CSRF    = "koi_csrf"
+)
+
+// Name of the form field and of the header that carry the CSRF token.
+const (
+	CSRF_FORM_FIELD = "csrf"
+	CSRF_HEADER     = "X-CSRF-Token"
+)
+
+// Authenticator identifies users by HTTP Basic credentials or by a session
+// cookie obtained through the login form. Users and their bcrypt password
+// hashes are read from a credentials file, with one "user:hash" per line,
+// as produced by e.g. `htpasswd -nB user`. Scripts and integrations are
+// identified by API tokens sent as Bearer credentials, see TokenStore.
+//
+// Sessions are kept in memory, so users need to log in again after restart.
+type Authenticator struct {
+	users         map[string][]byte
+	tokens        *TokenStore
+	protected     []string
+	sessionTTL    time.Duration
+	secureCookies bool
+
+	lock     sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	user    string
+	expires time.Time
+}
+
+// Principal is the authenticated user or API token making the request.
+// Users are granted every scope.
+type Principal struct {
+	Name  string
+	Scope string
+}
+
+type principalKey struct{}
+
+// Global authenticator, nil if authentication is not enabled.
+var _auth *Authenticator
+
+func newAuthenticator(config AuthConfig, secureCookies bool) (a *Authenticator, err error) {
+	a = &Authenticator{
+		users:         map[string][]byte{},
+		protected:     config.Protected,
+		sessionTTL:    time.Duration(config.SessionTTL),
+		secureCookies: secureCookies,
+		sessions:      map[string]*session{},
+	}
+	if config.Credentials != "" {
+		if a.users, err = readCredentials(config.Credentials); err != nil {
+			return nil, err
+		}
+	}
+	if config.Tokens != "" {
+		if a.tokens, err = newTokenStore(config.Tokens); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func readCredentials(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open credentials file: %v", err)
+	}
+	defer file.Close()
+
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(line, ":")
+		if !found || user == "" {
+			return nil, fmt.Errorf("credentials file %s, line %d: expected user:hash", path, lineNo)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("credentials file %s, line %d: invalid bcrypt hash: %v", path, lineNo, err)
+		}
+		users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %v", err)
+	}
+	return users, nil
+}
+
+// Compared against for unknown users, so that they take as long as known ones.
+var _dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	return hash
+})
+
+func (a *Authenticator) verify(user string, password string) bool {
+	hash, found := a.users[user]
+	if !found {
+		bcrypt.CompareHashAndPassword(_dummyHash(), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+func (a *Authenticator) newSession(user string) (token string, expires time.Time) {
+	token = randomToken()
+	expires = time.Now().Add(a.sessionTTL)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.sessions[token] = &session{user, expires}
+	// opportunistic cleanup of expired sessions
+	for t, s := range a.sessions {
+		if time.Now().After(s.expires) {
+			delete(a.sessions, t)
+		}
+	}
+	return
+}
+
+func (a *Authenticator) sessionUser(token string) string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	s, found := a.sessions[token]
+	if !found {
+		return ""
+	}
+	if time.Now().After(s.expires) {
+		delete(a.sessions, token)
+		return ""
+	}
+	return s.user
+}
+
+func (a *Authenticator) endSession(token string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.sessions, token)
+}
+
+func (a *Authenticator) isProtected(path string) bool {
+	for _, prefix := range a.protected {
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// authentication identifies the user making the request, rejects unsafe requests
+// without a valid CSRF token, and gates protected paths. Browsing everything else
+// does not require authentication.
+func authentication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _auth == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var principal *Principal
+		csrfExempt := false
+		if secret, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+			token := (*APIToken)(nil)
+			if _auth.tokens != nil {
+				token = _auth.tokens.lookup(strings.TrimSpace(secret))
+			}
+			if token == nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="koi"`)
+				http.Error(w, "Invalid API token.", http.StatusUnauthorized)
+				return
+			}
+			// browsers never attach Bearer credentials on their own
+			principal, csrfExempt = &Principal{Name: "token:" + token.ID, Scope: token.Scope}, true
+		} else if name, password, ok := r.BasicAuth(); ok {
+			if !_auth.verify(name, password) {
+				challenge(w)
+				return
+			}
+			// Scripts using Basic credentials are exempt from CSRF checks, but only when
+			// the request could not have been sent by a cross-site HTML form, since
+			// browsers attach cached Basic credentials automatically.
+			principal, csrfExempt = &Principal{Name: name, Scope: SCOPE_ADMIN}, !isFormContentType(r)
+		} else if cookie, err := r.Cookie(COOKIE_SESSION); err == nil {
+			if user := _auth.sessionUser(cookie.Value); user != "" {
+				principal = &Principal{Name: user, Scope: SCOPE_ADMIN}
+			}
+		}
+
+		if !isSafeMethod(r.Method) && !csrfExempt && !validCSRFToken(r) {
+			http.Error(w, "Invalid or missing CSRF token.", http.StatusForbidden)
+			return
+		}
+
+		if principal == nil && _auth.isProtected(r.URL.Path) {
+			if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			} else {
+				challenge(w)
+			}
+			return
+		}
+
+		if principal != nil {
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestPrincipal returns the authenticated user or token, or nil.
+func requestPrincipal(r *http.Request) *Principal {
+	principal, _ := r.Context().Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// requestUser returns the name of the authenticated user or token, or an empty string.
+func requestUser(r *http.Request) string {
+	if principal := requestPrincipal(r); principal != nil {
+		return principal.Name
+	}
+	return ""
+}
+
+// requireScope wraps an API handler so that it is called only if the request
+// is authorized for the scope. Anonymous requests are authorized only for
+// the read scope, and they see only public content.
+func requireScope(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal := requestPrincipal(r)
+		if principal == nil {
+			if scope != SCOPE_READ {
+				if _auth != nil && _auth.tokens != nil {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="koi"`)
+				}
+				writeJSONError(w, http.StatusUnauthorized, "Authentication required.")
+				return
+			}
+		} else if !scopeIncludes(principal.Scope, scope) {
+			writeJSONError(w, http.StatusForbidden, fmt.Sprintf("Scope %q required.", scope))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// requireAdmin wraps a page handler so that it is called only if the request is
+// authorized for the admin scope. Anonymous browsers are sent to the login form.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal := requestPrincipal(r)
+		if principal == nil {
+			if len(_auth.users) > 0 && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			} else {
+				challenge(w)
+			}
+			return
+		}
+		if !scopeIncludes(principal.Scope, SCOPE_ADMIN) {
+			http.Error(w, "Administrator access required.", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// isAdmin reports whether the request is authorized for the admin scope, i.e.
+// it was made by a user, or with an admin token.
+func isAdmin(r *http.Request) bool {
+	principal := requestPrincipal(r)
+	return principal != nil && scopeIncludes(principal.Scope, SCOPE_ADMIN)
+}
+
+func challenge(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="koi", charset="UTF-8"`)
+	http.Error(w, "Authentication required.", http.StatusUnauthorized)
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// Reports whether the content type of the request is one that an HTML form can send.
+func isFormContentType(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "", "application/x-www-form-urlencoded", "multipart/form-data", "text/plain":
+		return true
+	}
+	return false
+}
+
+// The CSRF token is valid if the one sent in the form or in the header
+// matches the one in the cookie (double-submit cookie pattern).
+func validCSRFToken(r *http.Request) bool {
+	cookie, err := r.Cookie(COOKIE_CSRF)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	token := r.Header.Get(CSRF_HEADER)
+	if token == "" && isFormContentType(r) {
+		token = r.PostFormValue(CSRF_FORM_FIELD)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) == 1
+}
+
+// csrfToken returns the CSRF token to be embedded in a form,
+// and sets the cookie with the token if it is not already set.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(COOKIE_CSRF); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	token := randomToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     COOKIE_CSRF,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   _auth != nil && _auth.secureCookies,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Only relative paths are accepted as login redirect targets.
+func safeRedirectTarget(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func renderLogin(w http.ResponseWriter, r *http.Request) {
+	renderLoginForm(w, r, http.StatusOK, "")
+}
+
+func renderLoginForm(w http.ResponseWriter, r *http.Request, status int, message string) {
+	w.Header().Set("Cache-Control", "no-store")
+	render(
+		w,
+		status,
+		HTMLPage{
+			Key:          "@login",
+			Title:        "Log in",
+			ErrorMessage: message,
+			CSRFToken:    csrfToken(w, r),
+			Next:         safeRedirectTarget(r.FormValue("next")),
+			Data:         &CommonBaseObject{},
+		},
+	)
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	user, password := r.PostFormValue("user"), r.PostFormValue("password")
+	if !_auth.verify(user, password) {
+		renderLoginForm(w, r, http.StatusUnauthorized, "Invalid user name or password.")
+		return
+	}
+	token, expires := _auth.newSession(user)
+	http.SetCookie(w, &http.Cookie{
+		Name:     COOKIE_SESSION,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   _auth.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+	trace(_https, "user %q logged in", user)
+	http.Redirect(w, r, safeRedirectTarget(r.PostFormValue("next")), http.StatusSeeOther)
+}
+
+// The logout form is rendered separately, since cached pages cannot embed CSRF tokens.
+func renderLogout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	render(
+		w,
+		http.StatusOK,
+		HTMLPage{
+			Key:       "@logout",
+			Title:     "Log out",
+			CSRFToken: csrfToken(w, r),
+			Data:      &CommonBaseObject{},
+		},
+	)
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(COOKIE_SESSION); err == nil {
+		_auth.endSession(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     COOKIE_SESSION,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   _auth.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
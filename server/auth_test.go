@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testAuth enables authentication with a tokens file holding a token with each
+// of the scopes, and returns their secrets by scope.
+func testAuth(t *testing.T) map[string]string {
+	t.Helper()
+	tokens, err := newTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets := map[string]string{}
+	for _, scope := range []string{SCOPE_READ, SCOPE_WRITE, SCOPE_ADMIN} {
+		if _, secrets[scope], err = tokens.create(scope, scope); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_auth = &Authenticator{users: map[string][]byte{}, tokens: tokens, sessions: map[string]*session{}}
+	t.Cleanup(func() { _auth = nil })
+	return secrets
+}
+
+func TestTokenScopes(t *testing.T) {
+	testStore(t)
+	if err := loadTemplates("../data", map[string]bool{}); err != nil {
+		t.Fatal(err)
+	}
+	secrets := testAuth(t)
+	handler := authentication(multiHandler())
+	get := func(path string, scope string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if scope != "" {
+			r.Header.Set("Authorization", "Bearer "+secrets[scope])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// item 1 is private
+	if w := get("/items/1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("anonymous: status %d, want 404", w.Code)
+	}
+	admin := get("/items/1", SCOPE_ADMIN)
+	if admin.Code != http.StatusOK || !strings.Contains(admin.Body.String(), `href="/items/1/delete"`) {
+		t.Errorf("admin token: status %d, want 200 with administration links", admin.Code)
+	}
+	for _, scope := range []string{SCOPE_READ, SCOPE_WRITE} {
+		w := get("/items/1", scope)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Dune") {
+			t.Errorf("%s token: status %d, want 200 with the private item", scope, w.Code)
+		}
+		if body := w.Body.String(); strings.Contains(body, `href="/trash"`) || strings.Contains(body, `href="/items/1/delete"`) {
+			t.Errorf("%s token: page has administration links", scope)
+		}
+		if w.Header().Get("ETag") == admin.Header().Get("ETag") {
+			t.Errorf("%s token: same ETag as the page for administrators", scope)
+		}
+		if w := get("/trash", scope); w.Code != http.StatusForbidden {
+			t.Errorf("%s token: /trash status %d, want 403", scope, w.Code)
+		}
+	}
+}
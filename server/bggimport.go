@@ -0,0 +1,223 @@
+package server
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Metadata keys of the boardgames type written by BGG imports, in this order.
+var _boardgameKeys = []string{"title", "bggId", "bggurl", "year", "players", "playTime", "designer", "category", "rating", "status", MKEY_TAGS}
+
+// Matches IDs in BGG links, e.g. https://boardgamegeek.com/boardgame/13/catan.
+var bggURLRE = regexp.MustCompile(`boardgamegeek\.com/boardgame(?:expansion)?/(\d+)`)
+
+// BGGItem is an item of a BoardGameGeek XML API 2 response, saved to a file.
+// Both collection responses (/collection, with stats and status) and thing
+// responses (/thing, with links to categories and designers) are supported.
+type BGGItem struct {
+	ObjectID string     `xml:"objectid,attr"`
+	ID       string     `xml:"id,attr"`
+	Subtype  string     `xml:"subtype,attr"`
+	Type     string     `xml:"type,attr"`
+	Names    []bggValue `xml:"name"`
+	Year     bggValue   `xml:"yearpublished"`
+
+	// collection responses
+	Stats struct {
+		MinPlayers  string   `xml:"minplayers,attr"`
+		MaxPlayers  string   `xml:"maxplayers,attr"`
+		MinPlayTime string   `xml:"minplaytime,attr"`
+		MaxPlayTime string   `xml:"maxplaytime,attr"`
+		Rating      bggValue `xml:"rating"`
+	} `xml:"stats"`
+	Status *struct {
+		Own        string `xml:"own,attr"`
+		PrevOwned  string `xml:"prevowned,attr"`
+		Preordered string `xml:"preordered,attr"`
+		Wishlist   string `xml:"wishlist,attr"`
+		WantToPlay string `xml:"wanttoplay,attr"`
+	} `xml:"status"`
+
+	// thing responses
+	MinPlayers  bggValue `xml:"minplayers"`
+	MaxPlayers  bggValue `xml:"maxplayers"`
+	MinPlayTime bggValue `xml:"minplaytime"`
+	MaxPlayTime bggValue `xml:"maxplaytime"`
+	Links       []struct {
+		Type  string `xml:"type,attr"`
+		Value string `xml:"value,attr"`
+	} `xml:"link"`
+}
+
+// bggValue is a value held either in the value attribute or in the element text.
+type bggValue struct {
+	// type of <name>: primary or alternate
+	NameType string `xml:"type,attr"`
+	Value    string `xml:"value,attr"`
+	Text     string `xml:",chardata"`
+}
+
+func (v bggValue) String() string {
+	if v.Value != "" {
+		return strings.TrimSpace(v.Value)
+	}
+	return strings.TrimSpace(v.Text)
+}
+
+// setupBGGImport sets up the import of a saved BGG XML file into the boardgames
+// type. Categories become tags, and games that already exist, by BGG ID (or
+// by the ID in the BGG link), are skipped.
+func setupBGGImport(flags *flag.FlagSet) func(io.Reader, *Importer) error {
+	ownedOnly := flags.Bool("owned", false, "import only games marked as owned")
+
+	return func(r io.Reader, importer *Importer) error {
+		if !importer.db.enabledTypes.Contains("boardgames") {
+			return fmt.Errorf("type %q is not enabled in the store file", "boardgames")
+		}
+
+		var response struct {
+			XMLName xml.Name
+			Items   []*BGGItem `xml:"item"`
+		}
+		if err := xml.NewDecoder(r).Decode(&response); err != nil {
+			return fmt.Errorf("failed to decode BGG file: %v", err)
+		}
+		if response.XMLName.Local != "items" {
+			// e.g. <message> saying that the collection export is still being prepared
+			return errors.New("failed to decode BGG file: expected <items>, is this a saved collection response?")
+		}
+
+		existing := map[string]*Item{}
+		for _, item := range importer.db.items {
+			if item.Type != "boardgames" {
+				continue
+			}
+			if id := item.Metadata["bggId"]; id != "" {
+				existing[id] = item
+			} else if match := bggURLRE.FindStringSubmatch(item.Metadata["bggurl"]); match != nil {
+				existing[match[1]] = item
+			}
+		}
+
+		for i, game := range response.Items {
+			id := game.ObjectID
+			if id == "" {
+				id = game.ID
+			}
+			source := fmt.Sprintf("item %d (BGG ID %s)", i+1, id)
+			if *ownedOnly && (game.Status == nil || game.Status.Own != "1") {
+				importer.skip(source, "not owned")
+				continue
+			}
+			if item := existing[id]; item != nil {
+				importer.skip(source, fmt.Sprintf("duplicate of item %d %q", item.ID, item.Label))
+				continue
+			}
+			importer.add(game.record(source, id))
+		}
+		return nil
+	}
+}
+
+// record converts the game to the metadata of the boardgames type.
+func (g *BGGItem) record(source string, id string) *ImportRecord {
+	metadata := map[string]string{
+		"year": g.Year.String(),
+	}
+	if id != "" {
+		metadata["bggId"] = id
+		metadata["bggurl"] = "https://boardgamegeek.com/boardgame/" + id
+	}
+
+	for _, name := range g.Names {
+		// collection responses have a single name, thing responses also have alternate names
+		if name.NameType == "" || name.NameType == "primary" {
+			metadata["title"] = name.String()
+			break
+		}
+	}
+
+	first := func(values ...string) string {
+		for _, value := range values {
+			if value != "" && value != "0" {
+				return value
+			}
+		}
+		return ""
+	}
+	metadata["players"] = bggRange(first(g.Stats.MinPlayers, g.MinPlayers.String()), first(g.Stats.MaxPlayers, g.MaxPlayers.String()), "")
+	metadata["playTime"] = bggRange(first(g.Stats.MinPlayTime, g.MinPlayTime.String()), first(g.Stats.MaxPlayTime, g.MaxPlayTime.String()), " min")
+
+	// BGG ratings are 1 to 10, ratings in the database are 1 to 5
+	if rating, err := strconv.ParseFloat(g.Stats.Rating.String(), 64); err == nil && rating >= 1 && rating <= 10 {
+		metadata["rating"] = strconv.Itoa(int(math.Ceil(rating / 2)))
+	}
+
+	if g.Status != nil {
+		switch {
+		case g.Status.Own == "1":
+			metadata["status"] = "owned"
+		case g.Status.Preordered == "1":
+			metadata["status"] = "preordered"
+		case g.Status.PrevOwned == "1":
+			metadata["status"] = "previously owned"
+		case g.Status.Wishlist == "1":
+			metadata["status"] = "wishlist"
+		case g.Status.WantToPlay == "1":
+			metadata["status"] = "want to play"
+		}
+	}
+
+	designers, categories, tags := []string{}, []string{}, []string{}
+	seen := map[string]bool{}
+	addTag := func(name string) {
+		if tag := tagFromName(name); tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	for _, link := range g.Links {
+		switch link.Type {
+		case "boardgamedesigner":
+			designers = append(designers, link.Value)
+		case "boardgamecategory":
+			categories = append(categories, link.Value)
+			addTag(link.Value)
+		}
+	}
+	if g.Subtype == "boardgameexpansion" || g.Type == "boardgameexpansion" {
+		addTag("expansion")
+	}
+	metadata["designer"] = strings.Join(designers, ", ")
+	metadata["category"] = strings.Join(categories, ", ")
+	metadata[MKEY_TAGS] = strings.Join(tags, ",")
+
+	return &ImportRecord{
+		Source:   source,
+		Type:     "boardgames",
+		Keys:     _boardgameKeys,
+		Metadata: metadata,
+		Identity: []string{"bggId"},
+	}
+}
+
+// bggRange formats a range of values, e.g. "2-4", or a single value.
+func bggRange(min string, max string, unit string) string {
+	switch {
+	case min == "" && max == "":
+		return ""
+	case min == "":
+		return max + unit
+	case max == "" || min == max:
+		return min + unit
+	default:
+		return min + "-" + max + unit
+	}
+}
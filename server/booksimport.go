@@ -0,0 +1,192 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metadata keys of the books type written by library imports, in this order.
+var _bookKeys = []string{"title", "author", "edition", "isbn", "dateCompleted", "completed", MKEY_SORTING_HINT, MKEY_TAGS}
+
+// Matches titles with the series in parentheses, e.g. "Leviathan Wakes (The Expanse, #1)".
+var seriesTitleRE = regexp.MustCompile(`^(.+?)\s*\(([^()]+?),?\s*#(\d+)(\.\d+)?\)$`)
+
+// LibraryBook is a book read from a library export file.
+type LibraryBook struct {
+	Title   string
+	Author  string
+	ISBN    string
+	Edition string
+	// date in any of the _libraryDateLayouts, or ""
+	DateRead string
+	// exclusive shelf or read status, e.g. "read" or "to-read"
+	Status  string
+	Shelves []string
+}
+
+var _libraryDateLayouts = []string{"2006/01/02", time.DateOnly, "2006/1/2"}
+
+// libraryFormat describes the CSV export file of a reading tracker.
+type libraryFormat struct {
+	required []string
+	read     func(field func(column string) string) *LibraryBook
+}
+
+var _goodreads = &libraryFormat{
+	required: []string{"Title", "Author", "Exclusive Shelf"},
+	read: func(field func(string) string) *LibraryBook {
+		book := &LibraryBook{
+			Title:    field("Title"),
+			Author:   field("Author"),
+			ISBN:     goodreadsISBN(field("ISBN13")),
+			DateRead: field("Date Read"),
+			Status:   field("Exclusive Shelf"),
+			Shelves:  strings.Split(field("Bookshelves"), ","),
+		}
+		if book.ISBN == "" {
+			book.ISBN = goodreadsISBN(field("ISBN"))
+		}
+		book.Edition = field("Binding")
+		if year := field("Year Published"); year != "" && book.Edition != "" {
+			book.Edition += ", " + year
+		}
+		return book
+	},
+}
+
+var _storygraph = &libraryFormat{
+	required: []string{"Title", "Authors", "Read Status"},
+	read: func(field func(string) string) *LibraryBook {
+		book := &LibraryBook{
+			Title:    field("Title"),
+			Author:   field("Authors"),
+			Edition:  field("Format"),
+			DateRead: field("Last Date Read"),
+			Status:   field("Read Status"),
+			Shelves:  strings.Split(field("Tags"), ","),
+		}
+		// the column holds internal IDs of books without an ISBN
+		if isbn := field("ISBN/UID"); isbnRE.MatchString(isbn) {
+			book.ISBN = isbn
+		}
+		return book
+	},
+}
+
+var isbnRE = regexp.MustCompile(`^(\d{9}[\dX]|\d{13})$`)
+
+// Goodreads writes ISBNs as formulas, e.g. ="0345391802", so that spreadsheets keep leading zeros.
+func goodreadsISBN(value string) string {
+	return strings.Trim(value, `="`)
+}
+
+// setupLibraryImport sets up the import of a library export file of a reading
+// tracker into the books type. Shelves (or tags) become tags, and books that
+// already exist, by title and author, are skipped.
+func setupLibraryImport(format *libraryFormat) func(*flag.FlagSet) func(io.Reader, *Importer) error {
+	return func(flags *flag.FlagSet) func(io.Reader, *Importer) error {
+		return func(r io.Reader, importer *Importer) error {
+			if !importer.db.enabledTypes.Contains("books") {
+				return fmt.Errorf("type %q is not enabled in the store file", "books")
+			}
+			columns := map[string]int{}
+			return readCSV(r, ',', importer,
+				func(header []string) error {
+					for i, column := range header {
+						columns[column] = i
+					}
+					for _, column := range format.required {
+						if _, found := columns[column]; !found {
+							return fmt.Errorf("column %q is missing, is this the right export file?", column)
+						}
+					}
+					return nil
+				},
+				func(source string, fields []string) {
+					field := func(column string) string {
+						if i, found := columns[column]; found {
+							return strings.TrimSpace(fields[i])
+						}
+						return ""
+					}
+					record, err := format.read(field).record(source)
+					if err != nil {
+						importer.reject(source, err)
+						return
+					}
+					importer.add(record)
+				},
+			)
+		}
+	}
+}
+
+// record converts the book to the metadata of the books type.
+func (b *LibraryBook) record(source string) (*ImportRecord, error) {
+	metadata := map[string]string{
+		"title":   b.Title,
+		"author":  b.Author,
+		"edition": b.Edition,
+		"isbn":    b.ISBN,
+	}
+
+	if match := seriesTitleRE.FindStringSubmatch(b.Title); match != nil {
+		// books of a series are sorted by their number in the series
+		metadata["title"] = match[1]
+		number, _ := strconv.Atoi(match[3])
+		metadata[MKEY_SORTING_HINT] = fmt.Sprintf("%s %03d%s", match[2], number, match[4])
+	}
+
+	if b.DateRead != "" {
+		var date time.Time
+		var err error
+		for _, layout := range _libraryDateLayouts {
+			if date, err = time.Parse(layout, b.DateRead); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q", b.DateRead)
+		}
+		metadata["dateCompleted"] = date.Format(time.DateOnly)
+	}
+	if b.Status == "read" || b.DateRead != "" {
+		metadata["completed"] = "Yes"
+	} else {
+		metadata["completed"] = "No"
+	}
+
+	tags := []string{}
+	seen := map[string]bool{"read": true}
+	for _, shelf := range append(b.Shelves, b.Status) {
+		if tag := tagFromName(shelf); tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	metadata[MKEY_TAGS] = strings.Join(tags, ",")
+
+	return &ImportRecord{
+		Source:   source,
+		Type:     "books",
+		Keys:     _bookKeys,
+		Metadata: metadata,
+		Identity: []string{"title", "author"},
+	}, nil
+}
+
+// tagFromName converts a shelf or a tag name from other services to a valid
+// tag, e.g. "Sci-Fi" to "scifi", or returns "" if nothing is left of it.
+func tagFromName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r
+		}
+		return -1
+	}, strings.ToLower(name))
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+)
+
+// Command is a subcommand of the program, invoked as `koipond <name> [arguments]`,
+// used to manage data without running the server.
+type Command struct {
+	Summary string
+	Run     func(args []string) error
+}
+
+// Set up in init, since commands refer to the map in their usage.
+var _commands map[string]*Command
+
+func init() {
+	_commands = map[string]*Command{
+		"diff": {
+			Summary: "compare two store files item by item",
+			Run:     runDiffCommand,
+		},
+		"dupes": {
+			Summary: "report likely duplicate items",
+			Run:     runDupesCommand,
+		},
+		"export": {
+			Summary: "export items as CSV or JSON",
+			Run:     runExportCommand,
+		},
+		"import": {
+			Summary: "import items from other formats into the store file",
+			Run:     runImportCommand,
+		},
+		"tokens": {
+			Summary: "create, list and revoke API tokens",
+			Run:     runTokensCommand,
+		},
+	}
+}
+
+// errUsage wraps errors caused by invalid command-line arguments.
+type errUsage struct {
+	error
+}
+
+// runCommand runs the named command if it exists. If it does not,
+// found is false and the server should be started instead.
+func runCommand(args []string) (exitCode int, found bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+	command, found := _commands[args[0]]
+	if !found {
+		return 0, false
+	}
+
+	// commands print their results to stdout, so traces go to stderr
+	_logger = newLogger(os.Stderr, LOG_FORMAT_TEXT, slog.LevelWarn)
+
+	err := command.Run(args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return EXIT_OK, true
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s: %v\n", filepath.Base(os.Args[0]), args[0], err)
+		if errors.As(err, &errUsage{}) {
+			return EXIT_CONFIG, true
+		}
+		return EXIT_FAILURE, true
+	}
+	return EXIT_OK, true
+}
+
+// printCommands prints the list of commands, used in the usage message of the server.
+func printCommands(w io.Writer) {
+	names := make([]string, 0, len(_commands))
+	for name := range _commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "Commands:\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n    \t%s\n", name, _commands[name].Summary)
+	}
+}
+
+// newCommandFlags returns a flag set for the command, with the -config flag.
+// The returned function reads the configuration, without validating the parts
+// of it that are used only by the server.
+func newCommandFlags(name string) (*flag.FlagSet, func() (*Config, error)) {
+	flags := flag.NewFlagSet(filepath.Base(os.Args[0])+" "+name, flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv(ENVV_CONFIG), "path to the JSON configuration `file`")
+	return flags, func() (*Config, error) {
+		config := defaultConfig()
+		if *configPath != "" {
+			if err := config.readFile(*configPath); err != nil {
+				return nil, err
+			}
+		}
+		if err := config.readEnvironment(); err != nil {
+			return nil, err
+		}
+		return config, nil
+	}
+}
+
+// parseFlags parses arguments and checks the number of positional arguments.
+func parseFlags(flags *flag.FlagSet, args []string, positional int) error {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage{err}
+	}
+	if flags.NArg() != positional {
+		flags.Usage()
+		return errUsage{fmt.Errorf("expected %d argument(s), got %d", positional, flags.NArg())}
+	}
+	return nil
+}
+
+func runTokensCommand(args []string) error {
+	usage := errUsage{errors.New("expected subcommand: create, list or revoke")}
+	if len(args) == 0 {
+		return usage
+	}
+
+	flags, readConfig := newCommandFlags("tokens " + args[0])
+	tokensPath := flags.String("tokens", "", "path to the API tokens `file` (default from configuration)")
+	openStore := func() (*TokenStore, error) {
+		config, err := readConfig()
+		if err != nil {
+			return nil, err
+		}
+		if *tokensPath != "" {
+			config.Auth.Tokens = *tokensPath
+		}
+		if config.Auth.Tokens == "" {
+			return nil, errUsage{errors.New("tokens file is not configured, see -tokens")}
+		}
+		return newTokenStore(config.Auth.Tokens)
+	}
+
+	switch args[0] {
+	case "create":
+		name := flags.String("name", "", "`name` describing what the token is used for")
+		scope := flags.String("scope", SCOPE_READ, "token `scope`: read, write or admin")
+		if err := parseFlags(flags, args[1:], 0); err != nil {
+			return err
+		}
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		token, secret, err := store.create(*name, *scope)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "created token %s with scope %q, it will not be shown again:\n", token.ID, token.Scope)
+		fmt.Println(secret)
+
+	case "list":
+		if err := parseFlags(flags, args[1:], 0); err != nil {
+			return err
+		}
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		tokens, err := store.list()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSCOPE\tCREATED\tNAME")
+		for _, token := range tokens {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", token.ID, token.Scope, token.Created.Format("2006-01-02 15:04:05"), token.Name)
+		}
+		tw.Flush()
+
+	case "revoke":
+		if err := parseFlags(flags, args[1:], 1); err != nil {
+			return err
+		}
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		if err = store.revoke(flags.Arg(0)); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "revoked token %s\n", flags.Arg(0))
+
+	default:
+		return usage
+	}
+
+	return nil
+}
@@ -0,0 +1,477 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds all settings of the server. Settings are read, in the order of
+// increasing precedence, from defaults, the JSON configuration file, environment
+// variables and command-line flags.
+type Config struct {
+	Listen            string          `json:"listen"`
+	Store             string          `json:"store"`
+	StorePollInterval Duration        `json:"storePollInterval"`
+	ShutdownTimeout   Duration        `json:"shutdownTimeout"`
+	Data              string          `json:"data"`
+	Rendering         map[string]bool `json:"rendering"`
+	Log               LogConfig       `json:"log"`
+	TLS               TLSConfig       `json:"tls"`
+	Auth              AuthConfig      `json:"auth"`
+	Limits            LimitsConfig    `json:"limits"`
+	Headers           HeadersConfig   `json:"headers"`
+	TrustedProxies    []string        `json:"trustedProxies"`
+	Dupes             DupesConfig     `json:"dupes"`
+	Trash             TrashConfig     `json:"trash"`
+}
+
+// TrashConfig holds settings of the trash. Deleted items are purged once they
+// have been in the trash longer than the retention period, unless it is 0.
+type TrashConfig struct {
+	Retention Duration `json:"retention"`
+}
+
+// DupesConfig holds settings of duplicate detection. Keys are the metadata
+// keys compared per type, and the threshold is the minimum similarity, from
+// 0 to 1, of all compared keys. Types without keys are compared by label.
+type DupesConfig struct {
+	Keys      map[string][]string `json:"keys"`
+	Threshold float64             `json:"threshold"`
+}
+
+// HeadersConfig holds settings of security headers sent with every response.
+// Empty values disable the corresponding headers. Unless the policy has its own
+// style-src and frame-ancestors directives, they are added to it, allowing the
+// inline styles of the templates.
+type HeadersConfig struct {
+	ContentSecurityPolicy string   `json:"contentSecurityPolicy"`
+	FrameAncestors        string   `json:"frameAncestors"`
+	ReferrerPolicy        string   `json:"referrerPolicy"`
+	ContentTypeOptions    bool     `json:"contentTypeOptions"`
+	HSTSMaxAge            Duration `json:"hstsMaxAge"`
+	HSTSIncludeSubdomains bool     `json:"hstsIncludeSubdomains"`
+}
+
+// LimitsConfig holds server timeouts and limits on requests. Rate limiting
+// is enabled when the rate (requests per second, per client) is positive.
+type LimitsConfig struct {
+	ReadHeaderTimeout Duration `json:"readHeaderTimeout"`
+	ReadTimeout       Duration `json:"readTimeout"`
+	WriteTimeout      Duration `json:"writeTimeout"`
+	IdleTimeout       Duration `json:"idleTimeout"`
+	MaxHeaderBytes    int      `json:"maxHeaderBytes"`
+	MaxBodyBytes      int64    `json:"maxBodyBytes"`
+	Rate              float64  `json:"rate"`
+	Burst             int      `json:"burst"`
+}
+
+// AuthConfig holds authentication settings. Authentication is enabled
+// when the credentials file or the tokens file is set.
+type AuthConfig struct {
+	Credentials string   `json:"credentials"`
+	Tokens      string   `json:"tokens"`
+	SessionTTL  Duration `json:"sessionTTL"`
+	Protected   []string `json:"protected"`
+}
+
+func (c *AuthConfig) enabled() bool {
+	return c.Credentials != "" || c.Tokens != ""
+}
+
+// TLSConfig holds settings for serving HTTPS. TLS is enabled when
+// both certificate and key files are set.
+type TLSConfig struct {
+	Cert           string `json:"cert"`
+	Key            string `json:"key"`
+	RedirectListen string `json:"redirectListen"`
+}
+
+// LogConfig holds logging settings.
+type LogConfig struct {
+	Format string `json:"format"`
+	Level  string `json:"level"`
+}
+
+// Duration is a time.Duration that is encoded in JSON as a string, e.g. "5s".
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Global configuration.
+var _config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:            "localhost:8072",
+		Store:             "store/koidata.xml",
+		StorePollInterval: Duration(5 * time.Second),
+		ShutdownTimeout:   Duration(5 * time.Second),
+		Data:              "data",
+		Rendering: map[string]bool{
+			"@enable-kanji":            false,
+			"@enable-list-decorations": true,
+		},
+		Log: LogConfig{
+			Format: LOG_FORMAT_TEXT,
+			Level:  "info",
+		},
+		Auth: AuthConfig{
+			SessionTTL: Duration(7 * 24 * time.Hour),
+			Protected:  []string{},
+		},
+		Limits: LimitsConfig{
+			ReadHeaderTimeout: Duration(10 * time.Second),
+			ReadTimeout:       Duration(30 * time.Second),
+			WriteTimeout:      Duration(60 * time.Second),
+			IdleTimeout:       Duration(120 * time.Second),
+			MaxHeaderBytes:    64 << 10,
+			MaxBodyBytes:      1 << 20,
+			Rate:              0,
+			Burst:             40,
+		},
+		Headers: HeadersConfig{
+			ContentSecurityPolicy: "default-src 'none'; img-src 'self'; font-src 'self'; form-action 'self'; base-uri 'none'",
+			FrameAncestors:        "'none'",
+			ReferrerPolicy:        "same-origin",
+			ContentTypeOptions:    true,
+			HSTSMaxAge:            Duration(180 * 24 * time.Hour),
+		},
+		TrustedProxies: []string{"127.0.0.0/8", "::1/128"},
+		Dupes: DupesConfig{
+			Keys: map[string][]string{
+				"books":      {"title", "author"},
+				"games":      {"title"},
+				"boardgames": {"title"},
+			},
+			Threshold: 0.85,
+		},
+		Trash: TrashConfig{
+			Retention: Duration(30 * 24 * time.Hour),
+		},
+	}
+}
+
+// Environment variables.
+const (
+	ENVV_CONFIG     = "KOIPOND_CONFIG"
+	ENVV_MODE       = "KOIPOND_MODE"
+	ENVV_PORT       = "KOIPOND_PORT"
+	ENVV_LISTEN     = "KOIPOND_LISTEN"
+	ENVV_STORE      = "KOIPOND_STORE"
+	ENVV_DATA       = "KOIPOND_DATA"
+	ENVV_RENDERING  = "KOIPOND_RENDERING"
+	ENVV_LOG_FORMAT = "KOIPOND_LOG_FORMAT"
+	ENVV_LOG_LEVEL  = "KOIPOND_LOG_LEVEL"
+	ENVV_TLS_CERT   = "KOIPOND_TLS_CERT"
+	ENVV_TLS_KEY    = "KOIPOND_TLS_KEY"
+	ENVV_AUTH       = "KOIPOND_AUTH_CREDENTIALS"
+	ENVV_TOKENS     = "KOIPOND_AUTH_TOKENS"
+)
+
+// readConfig builds the configuration from all sources, see Config.
+// It returns printOnly set to true if the user only asked for the
+// resulting configuration to be printed.
+func readConfig(args []string) (config *Config, printOnly bool, err error) {
+	var (
+		flags      = flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+		configPath = flags.String("config", os.Getenv(ENVV_CONFIG), "path to the JSON configuration `file`")
+		listen     = flags.String("listen", "", "TCP `address` to listen on, e.g. localhost:8072")
+		store      = flags.String("store", "", "path to the XML database `file`")
+		data       = flags.String("data", "", "path to the `directory` with templates and static files")
+		rendering  = flags.String("rendering", "", "comma-separated rendering `flags`, e.g. @enable-kanji=true,@enable-list-decorations=false")
+		logFormat  = flags.String("log-format", "", "log `format`: text or json")
+		logLevel   = flags.String("log-level", "", "minimum log `level`: debug, info, warn or error")
+		tlsCert    = flags.String("tls-cert", "", "path to the PEM encoded TLS certificate `file`")
+		tlsKey     = flags.String("tls-key", "", "path to the PEM encoded TLS private key `file`")
+		redirect   = flags.String("tls-redirect-listen", "", "TCP `address` of the plain HTTP listener that redirects to HTTPS")
+		auth       = flags.String("auth-credentials", "", "path to the `file` with user:bcrypt-hash lines, enables authentication")
+		tokens     = flags.String("auth-tokens", "", "path to the API tokens `file`, enables authentication")
+		print      = flags.Bool("print-config", false, "print the resulting configuration and exit")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [flags]\n       %s <command> [arguments]\n\nFlags:\n", flags.Name(), flags.Name())
+		flags.PrintDefaults()
+		fmt.Fprintln(flags.Output())
+		printCommands(flags.Output())
+	}
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	if flags.NArg() > 0 {
+		err = fmt.Errorf("unexpected argument %q", flags.Arg(0))
+		return
+	}
+
+	config = defaultConfig()
+	if *configPath != "" {
+		if err = config.readFile(*configPath); err != nil {
+			return
+		}
+	}
+	if err = config.readEnvironment(); err != nil {
+		return
+	}
+
+	override := func(dst *string, src string) {
+		if src != "" {
+			*dst = src
+		}
+	}
+	override(&config.Listen, *listen)
+	override(&config.Store, *store)
+	override(&config.Data, *data)
+	if err = config.setRendering(*rendering); err != nil {
+		return
+	}
+	override(&config.Log.Format, *logFormat)
+	override(&config.Log.Level, *logLevel)
+	override(&config.TLS.Cert, *tlsCert)
+	override(&config.TLS.Key, *tlsKey)
+	override(&config.TLS.RedirectListen, *redirect)
+	override(&config.Auth.Credentials, *auth)
+	override(&config.Auth.Tokens, *tokens)
+
+	if err = config.validate(); err != nil {
+		return
+	}
+	printOnly = *print
+	return
+}
+
+func (c *Config) readFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %v", err)
+	}
+	if err = json.Unmarshal(content, c); err != nil {
+		return fmt.Errorf("failed to decode configuration file %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c *Config) readEnvironment() error {
+	// KOIPOND_MODE and KOIPOND_PORT are kept for backwards compatibility
+	if mode, port := os.Getenv(ENVV_MODE), os.Getenv(ENVV_PORT); mode != "" || port != "" {
+		if mode == "" {
+			mode = "prod"
+		}
+		if mode == "dev" {
+			c.Listen = "localhost:8072"
+		} else if mode == "prod" || mode == "prod-local-listener" {
+			if num, err := strconv.Atoi(port); err != nil || num < 1 || num > 65535 {
+				return fmt.Errorf("value of %s is invalid or is not a valid TCP port number", ENVV_PORT)
+			}
+			if mode == "prod-local-listener" {
+				c.Listen = "127.0.0.1:" + port
+			} else {
+				c.Listen = "0.0.0.0:" + port
+			}
+		} else {
+			return fmt.Errorf("value of %s is invalid", ENVV_MODE)
+		}
+	}
+
+	for envv, dst := range map[string]*string{
+		ENVV_LISTEN:     &c.Listen,
+		ENVV_STORE:      &c.Store,
+		ENVV_DATA:       &c.Data,
+		ENVV_LOG_FORMAT: &c.Log.Format,
+		ENVV_LOG_LEVEL:  &c.Log.Level,
+		ENVV_TLS_CERT:   &c.TLS.Cert,
+		ENVV_TLS_KEY:    &c.TLS.Key,
+		ENVV_AUTH:       &c.Auth.Credentials,
+		ENVV_TOKENS:     &c.Auth.Tokens,
+	} {
+		if value := os.Getenv(envv); value != "" {
+			*dst = value
+		}
+	}
+
+	return c.setRendering(os.Getenv(ENVV_RENDERING))
+}
+
+// setRendering sets rendering flags listed in the value, e.g.
+// "@enable-kanji=true,@enable-list-decorations=false". Flags that
+// are not listed keep their values. Unknown flags are left for validate.
+func (c *Config) setRendering(value string) error {
+	if value == "" {
+		return nil
+	}
+	for _, setting := range strings.Split(value, ",") {
+		flag, enabled, found := strings.Cut(strings.TrimSpace(setting), "=")
+		if !found {
+			return fmt.Errorf("rendering: invalid setting %q, expected flag=true or flag=false", setting)
+		}
+		b, err := strconv.ParseBool(enabled)
+		if err != nil {
+			return fmt.Errorf("rendering: invalid value of flag %q: %v", flag, err)
+		}
+		if c.Rendering == nil {
+			c.Rendering = map[string]bool{}
+		}
+		c.Rendering[flag] = b
+	}
+	return nil
+}
+
+func (c *Config) validate() (err error) {
+	if _, port, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("listen: invalid address %q: %v", c.Listen, err)
+	} else if num, err := strconv.Atoi(port); err != nil || num < 1 || num > 65535 {
+		return fmt.Errorf("listen: invalid TCP port number in %q", c.Listen)
+	}
+
+	if c.Store == "" {
+		return errors.New("store: path is empty")
+	}
+	if c.Store, err = filepath.Abs(c.Store); err != nil {
+		return fmt.Errorf("store: failed to compose full path: %v", err)
+	}
+	if c.StorePollInterval <= 0 {
+		return errors.New("storePollInterval: must be positive")
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdownTimeout: must be positive")
+	}
+
+	if c.Data == "" {
+		return errors.New("data: path is empty")
+	}
+	if c.Data, err = filepath.Abs(c.Data); err != nil {
+		return fmt.Errorf("data: failed to compose full path: %v", err)
+	}
+	if fi, err := os.Stat(c.Data); err != nil || !fi.IsDir() {
+		return fmt.Errorf("data: %s is not a directory", c.Data)
+	}
+
+	known := defaultConfig().Rendering
+	for flag := range c.Rendering {
+		if _, found := known[flag]; !found {
+			return fmt.Errorf("rendering: unknown flag %q", flag)
+		}
+	}
+
+	if _, err := newLogLevel(c.Log.Level); err != nil {
+		return fmt.Errorf("log: %v", err)
+	}
+	if c.Log.Format != LOG_FORMAT_TEXT && c.Log.Format != LOG_FORMAT_JSON {
+		return fmt.Errorf("log: invalid log format %q", c.Log.Format)
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("tls: both certificate and key files must be set")
+	}
+	if c.TLS.Cert != "" {
+		if _, err := tls.LoadX509KeyPair(c.TLS.Cert, c.TLS.Key); err != nil {
+			return fmt.Errorf("tls: %v", err)
+		}
+		if c.TLS.RedirectListen != "" {
+			if _, _, err := net.SplitHostPort(c.TLS.RedirectListen); err != nil {
+				return fmt.Errorf("tls: invalid redirect listen address %q: %v", c.TLS.RedirectListen, err)
+			}
+		}
+	} else if c.TLS.RedirectListen != "" {
+		return errors.New("tls: redirect listen address is set, but TLS is not enabled")
+	}
+
+	if c.Auth.Credentials != "" {
+		if _, err := readCredentials(c.Auth.Credentials); err != nil {
+			return fmt.Errorf("auth: %v", err)
+		}
+	}
+	if c.Auth.Tokens != "" {
+		if _, err := newTokenStore(c.Auth.Tokens); err != nil {
+			return fmt.Errorf("auth: %v", err)
+		}
+	}
+	if c.Auth.enabled() {
+		if c.Auth.SessionTTL <= 0 {
+			return errors.New("auth: sessionTTL must be positive")
+		}
+		for _, path := range c.Auth.Protected {
+			if !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("auth: protected path %q must start with /", path)
+			}
+		}
+	}
+
+	for name, timeout := range map[string]Duration{
+		"readHeaderTimeout": c.Limits.ReadHeaderTimeout,
+		"readTimeout":       c.Limits.ReadTimeout,
+		"writeTimeout":      c.Limits.WriteTimeout,
+		"idleTimeout":       c.Limits.IdleTimeout,
+	} {
+		if timeout < 0 {
+			return fmt.Errorf("limits: %s must not be negative", name)
+		}
+	}
+	if c.Limits.MaxHeaderBytes < 0 || c.Limits.MaxBodyBytes < 0 {
+		return errors.New("limits: maximum sizes must not be negative")
+	}
+	if c.Limits.Rate < 0 {
+		return errors.New("limits: rate must not be negative")
+	}
+	if c.Limits.Rate > 0 && c.Limits.Burst < 1 {
+		return errors.New("limits: burst must be at least 1 when rate limiting is enabled")
+	}
+
+	if strings.ContainsAny(c.Headers.ContentSecurityPolicy+c.Headers.FrameAncestors+c.Headers.ReferrerPolicy, "\r\n") {
+		return errors.New("headers: values must not contain line breaks")
+	}
+	if c.Headers.HSTSMaxAge < 0 {
+		return errors.New("headers: hstsMaxAge must not be negative")
+	}
+
+	if _, err := parseNetworks(c.TrustedProxies); err != nil {
+		return fmt.Errorf("trustedProxies: %v", err)
+	}
+
+	if c.Dupes.Threshold <= 0 || c.Dupes.Threshold > 1 {
+		return errors.New("dupes: threshold must be greater than 0 and at most 1")
+	}
+	for typeKey, keys := range c.Dupes.Keys {
+		for _, key := range keys {
+			if key == "" {
+				return fmt.Errorf("dupes: empty key for type %q", typeKey)
+			}
+		}
+	}
+
+	if c.Trash.Retention < 0 {
+		return errors.New("trash: retention must not be negative")
+	}
+
+	return nil
+}
+
+func (c *Config) print() {
+	out, _ := json.MarshalIndent(c, "", "    ")
+	fmt.Fprintln(os.Stdout, string(out))
+}
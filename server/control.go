@@ -4,12 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var _serverControl control
@@ -21,67 +22,159 @@ type control struct {
 	running        bool
 	closed         bool
 	failure        chan error
+	// set as soon as shutdown starts, see serveReadiness
+	stopping atomic.Bool
+
+	// after shutdownTimeout, connections that are still active are closed
+	shutdownTimeout time.Duration
+	// called after the server is closed, e.g. to flush pending writes
+	shutdownHooks []func() error
 
 	https    *http.Server
 	endpoint string
+	// timeouts and maximum header size of the server, 0 means no limit
+	limits LimitsConfig
+
+	// TLS is enabled if certFile and keyFile are set
+	certFile string
+	keyFile  string
+	certs    *certReloader
+
+	// plain HTTP server redirecting to HTTPS, if redirectEndpoint is set
+	redirect         *http.Server
+	redirectEndpoint string
 }
 
-func (c *control) boot() {
-	c.init()
+func (c *control) boot() error {
+	if err := c.init(); err != nil {
+		return err
+	}
 	c.start()
-	c.wait()
+	return c.wait()
 }
 
-func (c *control) init() {
+// onShutdown registers a function to be called after the server is closed.
+func (c *control) onShutdown(hook func() error) {
+	c.shutdownHooks = append(c.shutdownHooks, hook)
+}
+
+func (c *control) tlsEnabled() bool {
+	return c.certFile != "" && c.keyFile != ""
+}
+
+func (c *control) init() error {
 	c.https = &http.Server{
-		Addr:     c.endpoint,
-		Handler:  multiHandler(),
-		ErrorLog: log.New(io.Discard, "", 0),
+		Addr:              c.endpoint,
+		Handler:           chain(multiHandler(), accessLogging, securityHeaders, rateLimiting, bodyLimiting, authentication, gzipCompression),
+		ErrorLog:          traceLogger(_https),
+		ReadHeaderTimeout: time.Duration(c.limits.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(c.limits.ReadTimeout),
+		WriteTimeout:      time.Duration(c.limits.WriteTimeout),
+		IdleTimeout:       time.Duration(c.limits.IdleTimeout),
+		MaxHeaderBytes:    c.limits.MaxHeaderBytes,
 	}
+
+	if c.tlsEnabled() {
+		certs, err := newCertReloader(c.certFile, c.keyFile)
+		if err != nil {
+			return err
+		}
+		c.certs = certs
+		c.https.TLSConfig = newTLSConfig(certs)
+		if c.redirectEndpoint != "" {
+			c.redirect = &http.Server{
+				Addr:              c.redirectEndpoint,
+				Handler:           redirectToHTTPS(c.endpoint),
+				ErrorLog:          traceLogger(_https),
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+		}
+	}
+
+	return nil
 }
 
 func (c *control) start() {
 	c.bootBlock.Do(func() {
-		c.shutdownSignal.Add(1)
-		c.failure = make(chan error)
-		go func() {
-			err := c.https.ListenAndServe()
-			c.shutdownSignal.Done()
-			if !errors.Is(err, http.ErrServerClosed) {
-				c.failure <- fmt.Errorf("error: server failed unexpectedly: %v", err)
+		c.failure = make(chan error, 2)
+		serve := func(server *http.Server, listenAndServe func() error) {
+			c.shutdownSignal.Add(1)
+			go func() {
+				err := listenAndServe()
+				c.shutdownSignal.Done()
+				if !errors.Is(err, http.ErrServerClosed) {
+					c.failure <- fmt.Errorf("error: server failed unexpectedly: %v", err)
+				}
+			}()
+			trace(_control, "server started listening on %s", server.Addr)
+		}
+
+		if c.tlsEnabled() {
+			go c.certs.watch()
+			serve(c.https, func() error { return c.https.ListenAndServeTLS("", "") })
+			if c.redirect != nil {
+				serve(c.redirect, c.redirect.ListenAndServe)
 			}
-		}()
+		} else {
+			serve(c.https, c.https.ListenAndServe)
+		}
 		c.running = true
-		trace(_control, "server started listening on %s", c.https.Addr)
 	})
 }
 
-func (c *control) wait() {
+func (c *control) wait() error {
 	c.assertRunning()
-	interrupts := make(chan os.Signal, 1)
-	signal.Notify(interrupts, os.Interrupt)
-	trace(_control, "main: waiting indefinitely for interrupt signal or server failure...")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	trace(_control, "main: waiting indefinitely for interrupt/termination signal or server failure...")
 	select {
-	case <-interrupts:
-		trace(_control, "main: interrupt signal received")
-		err := c.shutdown()
-		if err != nil {
-			panic(err)
+	case sig := <-signals:
+		trace(_control, "main: signal received: %v", sig)
+		if err := c.shutdown(); err != nil {
+			return err
 		}
 		trace(_control, "main: server closed")
+		return nil
 	case err := <-c.failure:
 		trace(_control, "main: failure signal received")
-		panic(err)
+		c.shutdown()
+		return err
 	}
 }
 
+// shutdown stops accepting new connections and waits for active ones to finish,
+// for at most shutdownTimeout. After that, remaining connections are closed.
+// Shutdown hooks are called in any case.
 func (c *control) shutdown() (err error) {
 	c.assertRunning()
 	c.shutdownBlock.Do(func() {
-		if err = c.https.Shutdown(context.TODO()); err != nil {
-			err = fmt.Errorf("error: shutdown: %v", err)
+		c.stopping.Store(true)
+		ctx, cancel := context.WithTimeout(context.Background(), c.shutdownTimeout)
+		defer cancel()
+
+		servers := []*http.Server{c.https}
+		if c.redirect != nil {
+			servers = append(servers, c.redirect)
+		}
+		for _, server := range servers {
+			if shutdownErr := server.Shutdown(ctx); shutdownErr != nil {
+				trace(_control, "main: connections still active after %v, closing them", c.shutdownTimeout)
+				server.Close()
+				if err == nil {
+					err = fmt.Errorf("error: shutdown: %v", shutdownErr)
+				}
+			}
 		}
 		c.shutdownSignal.Wait()
+
+		for _, hook := range c.shutdownHooks {
+			if hookErr := hook(); hookErr != nil {
+				traceError(_control, "main: shutdown: %v", hookErr)
+				if err == nil {
+					err = fmt.Errorf("error: shutdown: %v", hookErr)
+				}
+			}
+		}
 		c.closed = true
 	})
 	return
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// setupCSVImport sets up the import of a CSV file with a header row. Columns
+// are mapped to metadata keys by their headers: headers are used as keys,
+// unless the mapping file, a JSON object, maps them to other keys, e.g.
+// {"Title": "title", "Notes": ""}. Columns mapped to "" are left out.
+func setupCSVImport(flags *flag.FlagSet) func(io.Reader, *Importer) error {
+	typeKey := flags.String("type", "", "`type` of imported items, e.g. books")
+	mappingPath := flags.String("mapping", "", "path to the JSON `file` mapping column headers to metadata keys")
+	delimiter := flags.String("delimiter", ",", "column `delimiter`")
+
+	return func(r io.Reader, importer *Importer) error {
+		if *typeKey == "" {
+			return errUsage{errors.New("type of imported items is not set, see -type")}
+		}
+		if !importer.db.enabledTypes.Contains(*typeKey) {
+			return fmt.Errorf("type %q is not enabled in the store file", *typeKey)
+		}
+		comma, size := utf8.DecodeRuneInString(*delimiter)
+		if size == 0 || size != len(*delimiter) {
+			return errUsage{fmt.Errorf("invalid delimiter %q", *delimiter)}
+		}
+		mapping := map[string]string{}
+		if *mappingPath != "" {
+			content, err := os.ReadFile(*mappingPath)
+			if err != nil {
+				return fmt.Errorf("failed to read mapping file: %v", err)
+			}
+			if err = json.Unmarshal(content, &mapping); err != nil {
+				return fmt.Errorf("failed to decode mapping file %s: %v", *mappingPath, err)
+			}
+		}
+
+		var keys []string
+		return readCSV(r, comma, importer,
+			func(header []string) (err error) {
+				keys, err = mapColumns(header, mapping)
+				return
+			},
+			func(source string, fields []string) {
+				record := &ImportRecord{Source: source, Type: *typeKey, Metadata: map[string]string{}}
+				for i, key := range keys {
+					if key != "" {
+						record.Keys = append(record.Keys, key)
+						record.Metadata[key] = strings.TrimSpace(fields[i])
+					}
+				}
+				importer.add(record)
+			},
+		)
+	}
+}
+
+// readCSV reads a CSV file with a header row. Headers are passed to the header
+// function, and then rows are passed to the row function one by one, with the
+// line on which they start. Rows that cannot be read are rejected.
+func readCSV(r io.Reader, comma rune, importer *Importer, header func([]string) error, row func(string, []string)) error {
+	reader := csv.NewReader(r)
+	reader.Comma = comma
+	reader.FieldsPerRecord = -1
+	columns, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read header row: %v", err)
+	}
+	for i := range columns {
+		columns[i] = strings.TrimSpace(strings.TrimPrefix(columns[i], "\uFEFF"))
+	}
+	if err = header(columns); err != nil {
+		return err
+	}
+
+	for {
+		fields, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return err
+			}
+			importer.reject(fmt.Sprintf("line %d", parseErr.StartLine), parseErr.Err)
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+		source := fmt.Sprintf("line %d", line)
+		if len(fields) != len(columns) {
+			importer.reject(source, fmt.Errorf("expected %d columns, got %d", len(columns), len(fields)))
+			continue
+		}
+		row(source, fields)
+	}
+}
+
+// mapColumns returns the metadata key for every column, or "" if the column is left out.
+func mapColumns(header []string, mapping map[string]string) ([]string, error) {
+	keys := make([]string, len(header))
+	columns := map[string]string{}
+	for i, column := range header {
+		key, mapped := mapping[column]
+		if !mapped {
+			key = column
+		}
+		if key == "" {
+			continue
+		}
+		if !isValidMetadataKey(key) {
+			if mapped {
+				return nil, fmt.Errorf("column %q is mapped to invalid metadata key %q", column, key)
+			}
+			return nil, fmt.Errorf("column %q is not a valid metadata key, map it to one or to \"\" in the mapping file", column)
+		}
+		if other, found := columns[key]; found {
+			return nil, fmt.Errorf("columns %q and %q are both mapped to metadata key %q", other, column, key)
+		}
+		columns[key] = column
+		keys[i] = key
+	}
+	return keys, nil
+}
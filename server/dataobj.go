@@ -23,10 +23,13 @@ import (
 type Item struct {
 	CommonBaseObject
 
-	ID       int
-	Type     string
-	Label    string
-	Metadata map[string]string
+	ID         int
+	Type       string
+	Label      string
+	Visibility Visibility
+	Metadata   map[string]string
+	// hash of the item's attributes in the store file, see itemRevision
+	Revision string
 }
 
 // Catalogue is a collection of items grouped by type.
@@ -36,6 +39,7 @@ type Catalogue struct {
 	CommonBaseObject
 
 	groups   map[string][]*Item
+	objects  map[string][]DataObjectInterface
 	hideTags bool
 }
 
@@ -105,18 +109,23 @@ func (c *Catalogue) withHiddenTags() *Catalogue {
 
 // Groups implements DataObjectInterface.
 //
+// Groups are converted only once, when the catalogue is made, see convert().
+func (c *Catalogue) Groups() map[string][]DataObjectInterface {
+	return c.objects
+}
+
+// convert converts the groups of items to groups of data objects returned by Groups.
 // This is a bit of an expensive function, since Go doesn't allow conversion between []*Ptr to []interface{},
 // or in this case []*Item to []DataObjectInterface, so conversion needs to be done for each element in every group.
-func (c *Catalogue) Groups() map[string][]DataObjectInterface {
-	groups := make(map[string][]DataObjectInterface)
+func (c *Catalogue) convert() {
+	c.objects = make(map[string][]DataObjectInterface)
 	for k, v := range c.groups {
 		slice := make([]DataObjectInterface, len(v))
 		for j, i := range v {
 			slice[j] = i
 		}
-		groups[k] = slice
+		c.objects[k] = slice
 	}
-	return groups
 }
 
 // MultiGroup implements DataObjectInterface.
@@ -1,7 +1,10 @@
 package server
 
 import (
+	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"src.acicovic.me/koipond/set"
@@ -13,38 +16,91 @@ const (
 	MKEY_COLLECTIONS  string = "collections"
 	MKEY_TAGS         string = "tags"
 	MKEY_SORTING_HINT string = "sortBy"
+	MKEY_VISIBILITY   string = "visibility"
+
+	// optional, unlike Item.ID, it does not change when other items are added or removed
+	MKEY_UID string = "uid"
+
+	// set on items in the trash
+	MKEY_DELETED string = "deleted"
 )
 
 // Database is an item store.
 //
-// Database is initialized during server bootstrap, and should be
-// considered as R/O after that by all threads that need to access
-// the data. Concurrent R/W operations are not thread-safe. In fact,
-// none of the Database methods are thread-safe.
+// Database is built during server bootstrap (and again every time the
+// store file changes), and should be considered as R/O after that by all
+// threads that need to access the data. Concurrent R/W operations are not
+// thread-safe. In fact, none of the Database methods that modify the
+// Database are thread-safe. A modified store file results in a brand new
+// Database instance that replaces the global one, which also invalidates
+// everything cached for the old instance.
 type Database struct {
 	filePath     string
 	created      time.Time
 	lastModified time.Time
+	fileModTime  time.Time
+	version      string
+
+	loaded         time.Time
+	decodeDuration time.Duration
 
 	items        []*Item
 	collectioned map[string][]*Item
 	tagged       map[string][]*Item
+	// deleted items, which are not indexed, listed or served
+	trash []*Item
+
+	enabledTypes         set.Strings
+	declaredCollections  map[string]string
+	collectionVisibility map[string]Visibility
+	defaults             map[string]string
+
+	// precomputed for every audience, see precompute()
+	views [audienceCount]*View
+}
+
+// View is the part of the Database that can be seen by an audience,
+// with precomputed catalogues and a cache of rendered pages.
+type View struct {
+	db       *Database
+	audience Audience
+
+	everything           *Catalogue
+	collectionCatalogues map[string]*Catalogue
+	tagCatalogues        map[string]*Catalogue
+	listedCollections    map[string]string
+	tagCounts            map[string]int
 
-	enabledTypes        set.Strings
-	declaredCollections map[string]string
-	hiddenCollections   set.Strings
-	defaults            map[string]string
+	// rendered HTML pages, keyed by URL path
+	pagesLock  sync.RWMutex
+	pages      map[string][]byte
+	pagesLimit int
 }
 
+// Pages cached per view besides those of items, tags and collections,
+// e.g. lists and exports.
+const PAGE_CACHE_HEADROOM = 64
+
 // Global database instance.
-var _database = &Database{
-	items:               []*Item{},
-	collectioned:        map[string][]*Item{},
-	tagged:              map[string][]*Item{},
-	enabledTypes:        set.NewStringSet(),
-	declaredCollections: map[string]string{},
-	hiddenCollections:   set.NewStringSet(),
-	defaults:            map[string]string{},
+var _database atomic.Pointer[Database]
+
+func newDatabase() *Database {
+	return &Database{
+		items:                []*Item{},
+		collectioned:         map[string][]*Item{},
+		tagged:               map[string][]*Item{},
+		trash:                []*Item{},
+		enabledTypes:         set.NewStringSet(),
+		declaredCollections:  map[string]string{},
+		collectionVisibility: map[string]Visibility{},
+		defaults:             map[string]string{},
+	}
+}
+
+// currentDatabase returns the Database instance that should be used
+// to serve a request. Handlers should call it only once per request.
+func currentDatabase() *Database {
+	return _database.Load()
 }
 
 // Creates and adds a new item to the Database. The function
@@ -54,6 +110,7 @@ func (db *Database) add(typeKey string, metadata map[string]string) *Item {
 		ID:       len(db.items),
 		Type:     typeKey,
 		Metadata: metadata,
+		Revision: itemRevision(metadata),
 	}
 	metadata = nil
 
@@ -71,14 +128,21 @@ func (db *Database) add(typeKey string, metadata map[string]string) *Item {
 		}
 	}
 
-	// index collection (invalid and hidden collections are cleaned out)
+	// invalid visibility is treated as private, to err on the safe side
+	if visibility, err := parseVisibility(item.Metadata[MKEY_VISIBILITY]); err != nil {
+		traceWarning(_decoder, "item %q of type %q: %v, item will be private", item.Label, typeKey, err)
+		item.Visibility = VISIBILITY_PRIVATE
+	} else {
+		item.Visibility = visibility
+	}
+
+	// index collection (invalid and undeclared collections are cleaned out)
 	if collections := item.Metadata[MKEY_COLLECTIONS]; collections != "" {
 		validCollections := []string{}
 		for _, collectionKey := range strings.Split(collections, ",") {
 			collectionKey = strings.TrimSpace(collectionKey)
 			if isValidCollectionKey(collectionKey) {
-				_, declared := db.declaredCollections[collectionKey]
-				if declared && !db.hiddenCollections.Contains(collectionKey) {
+				if _, declared := db.declaredCollections[collectionKey]; declared {
 					validCollections = append(validCollections, collectionKey)
 				}
 			}
@@ -108,40 +172,186 @@ func (db *Database) add(typeKey string, metadata map[string]string) *Item {
 	return item
 }
 
-func (db *Database) collections() map[string]string {
-	collections := make(map[string]string)
-	for key := range db.collectioned {
-		collections[key] = db.declaredCollections[key]
+// addTrashed adds a deleted item to the trash. Unlike items added by add, its ID
+// is its position in the trash, and its metadata is kept as it is in the store file.
+func (db *Database) addTrashed(typeKey string, metadata map[string]string) *Item {
+	item := &Item{
+		ID:         len(db.trash),
+		Type:       typeKey,
+		Visibility: VISIBILITY_PRIVATE,
+		Metadata:   metadata,
+		Revision:   itemRevision(metadata),
+	}
+	if ok := item.setLabel(); !ok {
+		return nil
 	}
-	return collections
+	db.trash = append(db.trash, item)
+	return item
 }
 
-func (db *Database) tags() map[string]int {
-	tags := map[string]int{}
-	for tag, items := range db.tagged {
-		tags[tag] = len(items)
+// validateItem checks the metadata of a new item against the rules applied by add.
+// Unlike add, which silently cleans out invalid collections and tags, and makes
+// items with invalid visibility private, it rejects such metadata.
+func (db *Database) validateItem(typeKey string, metadata map[string]string) error {
+	if !db.enabledTypes.Contains(typeKey) {
+		return fmt.Errorf("type %q is not enabled", typeKey)
+	}
+	for key := range metadata {
+		if !isValidMetadataKey(key) {
+			return fmt.Errorf("invalid metadata key %q", key)
+		}
+	}
+	if metadata[ItemLabelKey(typeKey)] == "" {
+		return fmt.Errorf("%s is missing", ItemLabelKey(typeKey))
+	}
+	if _, err := parseVisibility(metadata[MKEY_VISIBILITY]); err != nil {
+		return err
+	}
+	if collections := metadata[MKEY_COLLECTIONS]; collections != "" {
+		for _, collectionKey := range strings.Split(collections, ",") {
+			collectionKey = strings.TrimSpace(collectionKey)
+			if !isValidCollectionKey(collectionKey) {
+				return fmt.Errorf("invalid collection key %q", collectionKey)
+			}
+			if _, declared := db.declaredCollections[collectionKey]; !declared {
+				return fmt.Errorf("collection %q is not declared", collectionKey)
+			}
+		}
 	}
-	return tags
+	if tags := metadata[MKEY_TAGS]; tags != "" {
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); !isValidTag(tag) {
+				return fmt.Errorf("invalid tag %q", tag)
+			}
+		}
+	}
+	return nil
 }
 
 func (db *Database) lastID() int {
 	return len(db.items) - 1
 }
 
-func (db *Database) singleItem(id int) *Item {
-	return db.items[id]
+// view returns the part of the Database that the audience can see.
+func (db *Database) view(a Audience) *View {
+	return db.views[a]
 }
 
-func (db *Database) catalogueOfEverything() *Catalogue {
-	return makeCatalogue(db.items)
+// Builds all catalogues that can be requested by every audience, so that
+// filtering, grouping, sorting and conversion is done only once per Database
+// instance instead of once per request. Must be called after all items are added.
+func (db *Database) precompute() {
+	for a := Audience(0); a < audienceCount; a++ {
+		db.views[a] = newView(db, a)
+	}
 }
 
-func (db *Database) catalogueForCollection(key string) *Catalogue {
-	return makeCatalogue(db.collectioned[key])
+func newView(db *Database, a Audience) *View {
+	v := &View{
+		db:                   db,
+		audience:             a,
+		collectionCatalogues: map[string]*Catalogue{},
+		tagCatalogues:        map[string]*Catalogue{},
+		listedCollections:    map[string]string{},
+		tagCounts:            map[string]int{},
+		pages:                map[string][]byte{},
+		// HTML pages for visitors and administrators and a JSON object for every
+		// item, tag and collection, so that requests for arbitrary paths cannot
+		// grow the cache further
+		pagesLimit: 3*(len(db.items)+len(db.tagged)+len(db.declaredCollections)) + PAGE_CACHE_HEADROOM,
+	}
+
+	v.everything = makeCatalogue(v.listed(db.items))
+	if v.everything != nil {
+		v.everything.withHiddenTags()
+	}
+	for key, items := range db.collectioned {
+		visibility := db.collectionVisibility[key]
+		if !visibility.accessibleTo(a) {
+			continue
+		}
+		if catalogue := makeCatalogue(v.listed(items)); catalogue != nil {
+			v.collectionCatalogues[key] = catalogue
+			if visibility.listedFor(a) {
+				v.listedCollections[key] = db.declaredCollections[key]
+			}
+		}
+	}
+	for tag, items := range db.tagged {
+		if listed := v.listed(items); len(listed) > 0 {
+			v.tagCatalogues[tag] = makeCatalogue(listed).withHiddenTags()
+			v.tagCounts[tag] = len(listed)
+		}
+	}
+
+	return v
+}
+
+func (v *View) listed(items []*Item) []*Item {
+	listed := make([]*Item, 0, len(items))
+	for _, item := range items {
+		if item.Visibility.listedFor(v.audience) {
+			listed = append(listed, item)
+		}
+	}
+	return listed
+}
+
+func (v *View) collections() map[string]string {
+	return v.listedCollections
+}
+
+func (v *View) tags() map[string]int {
+	return v.tagCounts
+}
+
+// singleItem returns the item, or nil if it does not exist or is not accessible.
+func (v *View) singleItem(id int) *Item {
+	if id < 0 || id > v.db.lastID() {
+		return nil
+	}
+	if item := v.db.items[id]; item.Visibility.accessibleTo(v.audience) {
+		return item
+	}
+	return nil
+}
+
+func (v *View) catalogueOfEverything() *Catalogue {
+	return v.everything
+}
+
+func (v *View) catalogueForCollection(key string) *Catalogue {
+	return v.collectionCatalogues[key]
+}
+
+func (v *View) catalogueOfTaggedItems(tag string) *Catalogue {
+	return v.tagCatalogues[tag]
 }
 
-func (db *Database) catalogueOfTaggedItems(tag string) *Catalogue {
-	return makeCatalogue(db.tagged[tag])
+// Returns the time of the last known modification of the database,
+// whichever is later of the declared one and the store file one.
+func (db *Database) modified() time.Time {
+	if db.fileModTime.After(db.lastModified) {
+		return db.fileModTime
+	}
+	return db.lastModified
+}
+
+func (v *View) cachedPage(path string) (page []byte, found bool) {
+	v.pagesLock.RLock()
+	defer v.pagesLock.RUnlock()
+	page, found = v.pages[path]
+	return
+}
+
+// cachePage caches the page, unless the cache is full, in which case
+// the page is rendered again when it is requested.
+func (v *View) cachePage(path string, page []byte) {
+	v.pagesLock.Lock()
+	defer v.pagesLock.Unlock()
+	if len(v.pages) < v.pagesLimit {
+		v.pages[path] = page
+	}
 }
 
 func makeCatalogue(items []*Item) *Catalogue {
@@ -155,6 +365,7 @@ func makeCatalogue(items []*Item) *Catalogue {
 	for _, group := range catalogue.groups {
 		Sort(group)
 	}
+	catalogue.convert()
 
 	return catalogue
 }
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// DatabaseDiff holds the differences between two versions of a store file.
+type DatabaseDiff struct {
+	Types       *SetDiff       `json:"types"`
+	Collections []*ValueChange `json:"collections"`
+	Tags        *SetDiff       `json:"tags"`
+	Defaults    []*ValueChange `json:"defaults"`
+	Added       []*ItemRef     `json:"added"`
+	Removed     []*ItemRef     `json:"removed"`
+	Changed     []*ItemChange  `json:"changed"`
+}
+
+// SetDiff holds elements added to and removed from a set.
+type SetDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// ValueChange is a changed value of a key. Old is empty if the key was added,
+// and New is empty if it was removed.
+type ValueChange struct {
+	Key string `json:"key"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// ItemRef identifies an item in one of the versions.
+type ItemRef struct {
+	ID    int    `json:"id"`
+	Type  string `json:"type"`
+	Label string `json:"label"`
+}
+
+// ItemChange holds changed metadata of an item found in both versions.
+type ItemChange struct {
+	Type    string         `json:"type"`
+	Label   string         `json:"label"`
+	OldID   int            `json:"oldId"`
+	NewID   int            `json:"newId"`
+	Changes []*ValueChange `json:"changes"`
+}
+
+// empty reports whether the versions are the same.
+func (d *DatabaseDiff) empty() bool {
+	return len(d.Types.Added)+len(d.Types.Removed)+len(d.Collections)+len(d.Tags.Added)+len(d.Tags.Removed)+
+		len(d.Defaults)+len(d.Added)+len(d.Removed)+len(d.Changed) == 0
+}
+
+// storeVersion is a decoded store file, with the attributes of its items as they
+// are written in it, i.e. without defaults, indexed by Item.ID.
+type storeVersion struct {
+	db    *Database
+	attrs []map[string]string
+}
+
+// diffDatabases compares two versions of a store file. Items are matched by their
+// persistent IDs (see MKEY_UID) if both have one, and otherwise by type and label,
+// ignoring case and punctuation, in the order in which they appear. Item.ID is not
+// used, since it changes whenever an item is added or removed before another one.
+// The attributes of items are compared as they are written in the files, changed
+// defaults are listed separately.
+func diffDatabases(beforeVersion *storeVersion, afterVersion *storeVersion) *DatabaseDiff {
+	before, after := beforeVersion.db, afterVersion.db
+	diff := &DatabaseDiff{
+		Types:       diffSets(before.enabledTypes.ToSlice(), after.enabledTypes.ToSlice()),
+		Collections: diffMaps(collectionValues(before), collectionValues(after)),
+		Tags:        diffSets(mapKeys(before.tagged), mapKeys(after.tagged)),
+		Defaults:    diffMaps(before.defaults, after.defaults),
+		Added:       []*ItemRef{},
+		Removed:     []*ItemRef{},
+		Changed:     []*ItemChange{},
+	}
+
+	byUID := map[string]*Item{}
+	byLabel := map[string][]*Item{}
+	for _, item := range after.items {
+		if uid := item.Metadata[MKEY_UID]; uid != "" {
+			byUID[item.Type+"/"+uid] = item
+		}
+		key := item.Type + "/" + identityValue(item.Label)
+		byLabel[key] = append(byLabel[key], item)
+	}
+
+	matched := map[*Item]bool{}
+	match := func(item *Item) *Item {
+		uid := item.Metadata[MKEY_UID]
+		if other := byUID[item.Type+"/"+uid]; uid != "" && other != nil && !matched[other] {
+			return other
+		}
+		for _, other := range byLabel[item.Type+"/"+identityValue(item.Label)] {
+			otherUID := other.Metadata[MKEY_UID]
+			if !matched[other] && (uid == "" || otherUID == "" || uid == otherUID) {
+				return other
+			}
+		}
+		return nil
+	}
+
+	for _, item := range before.items {
+		other := match(item)
+		if other == nil {
+			diff.Removed = append(diff.Removed, &ItemRef{ID: item.ID, Type: item.Type, Label: item.Label})
+			continue
+		}
+		matched[other] = true
+		if changes := diffMaps(beforeVersion.attrs[item.ID], afterVersion.attrs[other.ID]); len(changes) > 0 {
+			diff.Changed = append(diff.Changed, &ItemChange{
+				Type:    other.Type,
+				Label:   other.Label,
+				OldID:   item.ID,
+				NewID:   other.ID,
+				Changes: changes,
+			})
+		}
+	}
+	for _, item := range after.items {
+		if !matched[item] {
+			diff.Added = append(diff.Added, &ItemRef{ID: item.ID, Type: item.Type, Label: item.Label})
+		}
+	}
+
+	return diff
+}
+
+// collectionValues describes declared collections by their names and visibility.
+func collectionValues(db *Database) map[string]string {
+	values := map[string]string{}
+	for key, name := range db.declaredCollections {
+		values[key] = name
+		if visibility := db.collectionVisibility[key]; visibility != VISIBILITY_PUBLIC {
+			values[key] += " (" + visibility.String() + ")"
+		}
+	}
+	return values
+}
+
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func diffSets(before []string, after []string) *SetDiff {
+	diff := &SetDiff{Added: []string{}, Removed: []string{}}
+	in := func(s []string, element string) bool {
+		for _, e := range s {
+			if e == element {
+				return true
+			}
+		}
+		return false
+	}
+	for _, element := range after {
+		if !in(before, element) {
+			diff.Added = append(diff.Added, element)
+		}
+	}
+	for _, element := range before {
+		if !in(after, element) {
+			diff.Removed = append(diff.Removed, element)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	return diff
+}
+
+// diffMaps returns changed values, ordered by key.
+func diffMaps(before map[string]string, after map[string]string) []*ValueChange {
+	changes := []*ValueChange{}
+	for key, value := range before {
+		if value != after[key] {
+			changes = append(changes, &ValueChange{Key: key, Old: value, New: after[key]})
+		}
+	}
+	for key, value := range after {
+		if _, found := before[key]; !found && value != "" {
+			changes = append(changes, &ValueChange{Key: key, New: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// writeText writes the differences in a form similar to unified diffs,
+// with + for added, - for removed and ~ for changed values.
+func (d *DatabaseDiff) writeText(w io.Writer) {
+	writeSet := func(name string, diff *SetDiff) {
+		if len(diff.Added)+len(diff.Removed) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "%s:", name)
+		for _, element := range diff.Added {
+			fmt.Fprintf(w, " +%s", element)
+		}
+		for _, element := range diff.Removed {
+			fmt.Fprintf(w, " -%s", element)
+		}
+		fmt.Fprintln(w)
+	}
+
+	writeSet("types", d.Types)
+	if len(d.Collections) > 0 {
+		fmt.Fprintln(w, "collections:")
+		writeValueChanges(w, "  ", d.Collections)
+	}
+	writeSet("tags", d.Tags)
+	if len(d.Defaults) > 0 {
+		fmt.Fprintln(w, "defaults:")
+		writeValueChanges(w, "  ", d.Defaults)
+	}
+	if len(d.Added)+len(d.Removed)+len(d.Changed) > 0 {
+		fmt.Fprintln(w, "items:")
+	}
+	for _, item := range d.Removed {
+		fmt.Fprintf(w, "  - %s #%d %q\n", item.Type, item.ID, item.Label)
+	}
+	for _, item := range d.Added {
+		fmt.Fprintf(w, "  + %s #%d %q\n", item.Type, item.ID, item.Label)
+	}
+	for _, item := range d.Changed {
+		id := fmt.Sprintf("#%d", item.NewID)
+		if item.OldID != item.NewID {
+			id = fmt.Sprintf("#%d -> #%d", item.OldID, item.NewID)
+		}
+		fmt.Fprintf(w, "  ~ %s %s %q\n", item.Type, id, item.Label)
+		writeValueChanges(w, "      ", item.Changes)
+	}
+	fmt.Fprintf(w, "%d items added, %d removed, %d changed\n", len(d.Added), len(d.Removed), len(d.Changed))
+}
+
+// writeValueChanges writes the changes one per line, with + for added,
+// - for removed and ~ for changed values.
+func writeValueChanges(w io.Writer, indent string, changes []*ValueChange) {
+	for _, change := range changes {
+		switch {
+		case change.Old == "":
+			fmt.Fprintf(w, "%s+ %s: %q\n", indent, change.Key, change.New)
+		case change.New == "":
+			fmt.Fprintf(w, "%s- %s: %q\n", indent, change.Key, change.Old)
+		default:
+			fmt.Fprintf(w, "%s~ %s: %q -> %q\n", indent, change.Key, change.Old, change.New)
+		}
+	}
+}
+
+// readStoreFile decodes the store file at the path, or from stdin if the path is "-".
+func readStoreFile(path string) (*storeVersion, error) {
+	var content []byte
+	var err error
+	if path == "-" {
+		content, err = io.ReadAll(os.Stdin)
+	} else {
+		content, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	db, err := DecodeDatabase(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	elements, _, err := scanItems(content, db.enabledTypes)
+	if err == nil && len(elements) != len(db.items) {
+		err = fmt.Errorf("found %d item elements for %d items", len(elements), len(db.items))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	version := &storeVersion{db: db, attrs: make([]map[string]string, len(elements))}
+	for i, element := range elements {
+		version.attrs[i] = element.metadata()
+	}
+	return version, nil
+}
+
+func runDiffCommand(args []string) error {
+	flags := flag.NewFlagSet(filepath.Base(os.Args[0])+" diff", flag.ContinueOnError)
+	format := flags.String("format", "text", "output `format`: text or json")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [flags] old.xml new.xml\n\nCompares two store files, use - for stdin.\n\nFlags:\n", flags.Name())
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, args, 2); err != nil {
+		return err
+	}
+	if *format != "text" && *format != "json" {
+		return errUsage{fmt.Errorf("invalid format %q", *format)}
+	}
+	if flags.Arg(0) == "-" && flags.Arg(1) == "-" {
+		return errUsage{errors.New("only one of the files can be read from stdin")}
+	}
+
+	before, err := readStoreFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	after, err := readStoreFile(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	diff := diffDatabases(before, after)
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(diff)
+	}
+	if diff.empty() {
+		fmt.Println("no differences")
+		return nil
+	}
+	diff.writeText(os.Stdout)
+	return nil
+}
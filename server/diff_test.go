@@ -0,0 +1,43 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffStoredAttributes(t *testing.T) {
+	_logger = newLogger(io.Discard, LOG_FORMAT_TEXT, slog.LevelError)
+	dir := t.TempDir()
+	read := func(name string, content string) *storeVersion {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		version, err := readStoreFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return version
+	}
+
+	// a changed default is listed once, not as a change of every item without
+	// a value of its own
+	after := strings.Replace(TEST_STORE, `default="English"`, `default="French"`, 1)
+	after = strings.Replace(after, `author="Frank Herbert"`, `author="F. Herbert"`, 1)
+	diff := diffDatabases(read("before.xml", TEST_STORE), read("after.xml", after))
+
+	if len(diff.Defaults) != 1 || diff.Defaults[0].Key != "books/lang" {
+		t.Errorf("changed defaults %v, want books/lang", diff.Defaults)
+	}
+	if len(diff.Changed) != 1 || diff.Changed[0].Label != "Dune" {
+		t.Fatalf("%d changed items, want only Dune", len(diff.Changed))
+	}
+	if changes := diff.Changed[0].Changes; len(changes) != 1 || changes[0].Key != "author" {
+		t.Errorf("changes of Dune %v, want only author", changes)
+	}
+}
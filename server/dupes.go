@@ -0,0 +1,292 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+)
+
+// Reasons of duplicate pairs.
+const (
+	DUPE_SAME_LABEL = "same label"
+	DUPE_SIMILAR    = "similar"
+)
+
+// DuplicatePair is a pair of items of the same type that are likely duplicates.
+type DuplicatePair struct {
+	Item  *Item
+	Other *Item
+	// the lowest similarity of compared key fields, where the same label counts as 1
+	Similarity float64
+	// DUPE_SAME_LABEL and/or DUPE_SIMILAR followed by the compared key fields
+	Reason string
+}
+
+// DuplicateReport holds duplicate pairs grouped by type label.
+//
+// DuplicateReport implements DataObjectInterface.
+type DuplicateReport struct {
+	CommonBaseObject
+
+	groups map[string][]*DuplicatePair
+}
+
+// Ref implements DataObjectInterface.
+func (d *DuplicateReport) Ref() any {
+	return d.groups
+}
+
+// HideTags implements DataObjectInterface.
+func (*DuplicateReport) HideTags() bool {
+	return true
+}
+
+// findDuplicates returns pairs of items of the same type whose key fields are all
+// at least as similar as the threshold, where the labels are compared ignoring
+// case and punctuation (see identityValue) first, and the same labels count as
+// similar. Key fields are configured per type, and default to the label, so that
+// e.g. books with the same title are not reported if their authors differ.
+// Fields that are empty in either item are not compared, and fields with
+// different numbers are never similar.
+// Pairs are ordered by type, by descending similarity, and by IDs.
+func findDuplicates(items []*Item, config DupesConfig) []*DuplicatePair {
+	byType := map[string][]*Item{}
+	for _, item := range items {
+		byType[item.Type] = append(byType[item.Type], item)
+	}
+
+	pairs := []*DuplicatePair{}
+	for typeKey, items := range byType {
+		keys := config.Keys[typeKey]
+		if len(keys) == 0 {
+			keys = []string{ItemLabelKey(typeKey)}
+		}
+		labels := make([]string, len(items))
+		for i, item := range items {
+			labels[i] = identityValue(item.Label)
+		}
+
+		for i, item := range items {
+			for j := i + 1; j < len(items); j++ {
+				other := items[j]
+				sameLabel := labels[i] != "" && labels[i] == labels[j]
+
+				lowest, compared := 1.0, []string{}
+				for _, key := range keys {
+					if sameLabel && key == ItemLabelKey(typeKey) {
+						continue
+					}
+					// spacing is ignored too, e.g. "J. R. R. Tolkien" and "JRR Tolkien" are equal
+					a := strings.ReplaceAll(identityValue(item.Metadata[key]), " ", "")
+					b := strings.ReplaceAll(identityValue(other.Metadata[key]), " ", "")
+					if a == "" || b == "" {
+						continue
+					}
+					// sequels and volumes differ only in numbers, e.g. "Half-Life 2"
+					if numbers(a) != numbers(b) {
+						lowest = 0
+						break
+					}
+					if lowest = min(lowest, similarity(a, b)); lowest < config.Threshold {
+						break
+					}
+					compared = append(compared, key)
+				}
+				if lowest < config.Threshold || (!sameLabel && len(compared) == 0) {
+					continue
+				}
+				reasons := []string{}
+				if sameLabel {
+					reasons = append(reasons, DUPE_SAME_LABEL)
+				}
+				if len(compared) > 0 {
+					reasons = append(reasons, DUPE_SIMILAR+" "+strings.Join(compared, ", "))
+				}
+				pairs = append(pairs, &DuplicatePair{
+					Item:       item,
+					Other:      other,
+					Similarity: lowest,
+					Reason:     strings.Join(reasons, ", "),
+				})
+			}
+		}
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		a, b := pairs[i], pairs[j]
+		switch {
+		case a.Item.Type != b.Item.Type:
+			return a.Item.Type < b.Item.Type
+		case a.Similarity != b.Similarity:
+			return a.Similarity > b.Similarity
+		case a.Item.ID != b.Item.ID:
+			return a.Item.ID < b.Item.ID
+		default:
+			return a.Other.ID < b.Other.ID
+		}
+	})
+	return pairs
+}
+
+// similarity returns 1 minus the Levenshtein distance between the strings,
+// relative to the length of the longer one, e.g. 0.9 for "the hobbit" and
+// "the hobit".
+func similarity(a string, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longer := max(len(ra), len(rb))
+	if longer == 0 {
+		return 1
+	}
+
+	// two rows of the distance matrix
+	previous, current := make([]int, len(rb)+1), make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return 1 - float64(previous[len(rb)])/float64(longer)
+}
+
+// numbers returns the digits in the string.
+func numbers(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// duplicateReport groups duplicate pairs of items listed for the audience.
+func (v *View) duplicateReport() *DuplicateReport {
+	report := &DuplicateReport{groups: map[string][]*DuplicatePair{}}
+	for _, pair := range findDuplicates(v.listed(v.db.items), _config.Dupes) {
+		label := GroupTypeLabel(pair.Item.Type)
+		report.groups[label] = append(report.groups[label], pair)
+	}
+	return report
+}
+
+// renderDupes handles /dupes, the report of likely duplicates for administrators.
+// Since comparing every pair of items is expensive, the report is made only if
+// the page is not cached.
+func renderDupes(w http.ResponseWriter, r *http.Request) {
+	view := currentDatabase().view(audienceOf(r))
+	page, found := view.cachedPage(r.URL.Path)
+	if !found {
+		var ok bool
+		page, ok = execute(HTMLPage{
+			Key:        "@dupes",
+			Supertitle: "Likely",
+			Title:      "Duplicates",
+			Admin:      true,
+			Data:       view.duplicateReport(),
+		})
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		view.cachePage(r.URL.Path, page)
+	}
+	serveVersioned(w, r, view, "text/html; charset=utf-8", page)
+}
+
+// DuplicateObject is the JSON representation of a duplicate pair.
+type DuplicateObject struct {
+	Type       string            `json:"type"`
+	Similarity float64           `json:"similarity"`
+	Reason     string            `json:"reason"`
+	Items      []DuplicateMember `json:"items"`
+}
+
+// DuplicateMember is an item of a duplicate pair.
+type DuplicateMember struct {
+	ID    int    `json:"id"`
+	Label string `json:"label"`
+	Link  string `json:"link"`
+}
+
+func runDupesCommand(args []string) error {
+	flags, readConfig := newCommandFlags("dupes")
+	storePath := flags.String("store", "", "path to the XML database `file` (default from configuration)")
+	typeKey := flags.String("type", "", "report only items of the `type`")
+	threshold := flags.Float64("threshold", 0, "minimum similarity of key fields, from 0 to 1 (default from configuration)")
+	format := flags.String("format", "text", "output `format`: text or json")
+	if err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	if *format != "text" && *format != "json" {
+		return errUsage{fmt.Errorf("invalid format %q", *format)}
+	}
+	if *threshold < 0 || *threshold > 1 {
+		return errUsage{errors.New("threshold must be from 0 to 1")}
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if *storePath != "" {
+		config.Store = *storePath
+	}
+	if *threshold > 0 {
+		config.Dupes.Threshold = *threshold
+	}
+	db, err := loadDatabase(config.Store)
+	if err != nil {
+		return err
+	}
+	if *typeKey != "" && !db.enabledTypes.Contains(*typeKey) {
+		return fmt.Errorf("type %q is not enabled in the store file", *typeKey)
+	}
+
+	items := db.items
+	if *typeKey != "" {
+		items = []*Item{}
+		for _, item := range db.items {
+			if item.Type == *typeKey {
+				items = append(items, item)
+			}
+		}
+	}
+	pairs := findDuplicates(items, config.Dupes)
+
+	if *format == "json" {
+		objects := make([]*DuplicateObject, len(pairs))
+		for i, pair := range pairs {
+			objects[i] = &DuplicateObject{Type: pair.Item.Type, Similarity: pair.Similarity, Reason: pair.Reason}
+			for _, item := range []*Item{pair.Item, pair.Other} {
+				objects[i].Items = append(objects[i].Items, DuplicateMember{ID: item.ID, Label: item.Label, Link: fmt.Sprintf("/items/%d", item.ID)})
+			}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(objects)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tSIMILARITY\tITEM\tLABEL\tOTHER\tLABEL\tREASON")
+	for _, pair := range pairs {
+		fmt.Fprintf(tw, "%s\t%.2f\t/items/%d\t%s\t/items/%d\t%s\t%s\n",
+			pair.Item.Type, pair.Similarity, pair.Item.ID, pair.Item.Label, pair.Other.ID, pair.Other.Label, pair.Reason)
+	}
+	tw.Flush()
+	fmt.Fprintf(os.Stderr, "%d likely duplicates\n", len(pairs))
+	return nil
+}
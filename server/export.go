@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Export formats.
+const (
+	EXPORT_CSV  = "csv"
+	EXPORT_JSON = "json"
+)
+
+// Columns written before metadata columns in CSV exports.
+var _exportColumns = []string{"id", "type", "label"}
+
+var errExportNotFound = errors.New("collection or tag not found")
+
+// exportItems returns items of the catalogue selected by collection or tag (or
+// all items, if neither is set) that are listed for the audience, ordered by ID.
+func (v *View) exportItems(collection string, tag string) ([]*Item, error) {
+	switch {
+	case collection != "" && tag != "":
+		return nil, errors.New("either collection or tag can be selected, not both")
+	case collection != "":
+		if v.catalogueForCollection(collection) == nil {
+			return nil, errExportNotFound
+		}
+		return sortedByID(v.listed(v.db.collectioned[collection])), nil
+	case tag != "":
+		if v.catalogueOfTaggedItems(tag) == nil {
+			return nil, errExportNotFound
+		}
+		return sortedByID(v.listed(v.db.tagged[tag])), nil
+	default:
+		return v.listed(v.db.items), nil
+	}
+}
+
+func sortedByID(items []*Item) []*Item {
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	return items
+}
+
+// writeExport writes the items in the format. CSV exports have a column for
+// every metadata key used by any of the items, in alphabetical order, after
+// the fixed columns, see _exportColumns. Values are escaped as per RFC 4180,
+// and guarded against formula injection, see csvCell.
+func (v *View) writeExport(w io.Writer, format string, items []*Item) error {
+	objects := make([]*ItemObject, len(items))
+	for i, item := range items {
+		objects[i] = v.itemObject(item)
+	}
+
+	switch format {
+	case EXPORT_JSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(objects)
+
+	case EXPORT_CSV:
+		keys := []string{}
+		seen := map[string]bool{}
+		for _, object := range objects {
+			for key := range object.Metadata {
+				if !seen[key] && !inLabelColumn(object.Type, key) {
+					seen[key] = true
+					keys = append(keys, key)
+				}
+			}
+		}
+		sort.Strings(keys)
+
+		writer := csv.NewWriter(w)
+		writer.Write(append(append([]string{}, _exportColumns...), keys...))
+		for _, object := range objects {
+			row := []string{strconv.Itoa(object.ID), object.Type, csvCell(object.Label)}
+			for _, key := range keys {
+				if inLabelColumn(object.Type, key) {
+					row = append(row, "")
+				} else {
+					row = append(row, csvCell(object.Metadata[key]))
+				}
+			}
+			writer.Write(row)
+		}
+		writer.Flush()
+		return writer.Error()
+
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// inLabelColumn reports whether the metadata key of items of the type is
+// already written in the label column, since it is the label key of the type.
+func inLabelColumn(typeKey string, key string) bool {
+	return key == ItemLabelKey(typeKey)
+}
+
+// csvCell returns the value prefixed with a single quote if it starts with a
+// character that makes spreadsheets evaluate it as a formula.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// serveExport handles /export.csv and /export.json, optionally with a
+// collection or tag query parameter selecting a catalogue.
+func serveExport(format string, contentType string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		view := currentDatabase().view(audienceOf(r))
+		collection, tag := r.URL.Query().Get("collection"), r.URL.Query().Get("tag")
+
+		// only the selecting parameters are part of the cache key
+		key := r.URL.Path + "?collection=" + collection + "&tag=" + tag
+		content, found := view.cachedPage(key)
+		if !found {
+			items, err := view.exportItems(collection, tag)
+			if errors.Is(err, errExportNotFound) {
+				http.Error(w, "Collection or tag not found.", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			buf := &bytes.Buffer{}
+			if err = view.writeExport(buf, format, items); err != nil {
+				traceError(_https, "export: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			content = buf.Bytes()
+			view.cachePage(key, content)
+		}
+
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, exportName(collection, tag), format))
+		serveVersioned(w, r, view, contentType, content)
+	}
+}
+
+func exportName(collection string, tag string) string {
+	switch {
+	case collection != "":
+		return "koi-collection-" + collection
+	case tag != "":
+		return "koi-tag-" + tag
+	default:
+		return "koi-items"
+	}
+}
+
+func runExportCommand(args []string) error {
+	flags, readConfig := newCommandFlags("export")
+	storePath := flags.String("store", "", "path to the XML database `file` (default from configuration)")
+	format := flags.String("format", EXPORT_CSV, "export `format`: csv or json")
+	collection := flags.String("collection", "", "export only items in the collection with the `key`")
+	tag := flags.String("tag", "", "export only items with the `tag`")
+	output := flags.String("o", "", "write to the `file` instead of stdout")
+	if err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	if *format != EXPORT_CSV && *format != EXPORT_JSON {
+		return errUsage{fmt.Errorf("invalid format %q", *format)}
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if *storePath != "" {
+		config.Store = *storePath
+	}
+	db, err := loadDatabase(config.Store)
+	if err != nil {
+		return err
+	}
+
+	// the owner of the store file sees everything
+	view := db.view(AUDIENCE_AUTHENTICATED)
+	items, err := view.exportItems(*collection, *tag)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	if err = view.writeExport(buf, *format, items); err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return writeFileAtomically(*output, buf.Bytes(), 0644)
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Metadata keys of the games type written by game library imports, in this order.
+var _gameKeys = []string{"title", "series", "platform", "developer", "category", "rating", "completed", "star", "steamAppId", "gogId", MKEY_TAGS}
+
+// Matches sequel numbers at the end of titles, e.g. "Portal 2" or "Heroes of Might and Magic III".
+// Roman numerals are also letters of titles, e.g. "Mega Man X", see detectSeries.
+var sequelRE = regexp.MustCompile(`^(.+?)\s+(?:(\d{1,2})|II|III|IV|V|VI|VII|VIII|IX|X)$`)
+
+// Names of user tags that mark favourite games in GOG libraries, in lowercase.
+var _gogFavouriteTags = map[string]bool{"favorite": true, "favorites": true, "favourite": true, "favourites": true}
+
+// LibraryGame is a game read from a library file of a game store.
+type LibraryGame struct {
+	// metadata key and value of the ID in the store, e.g. "steamAppId"
+	IDKey string
+	ID    string
+
+	Title     string
+	Platform  string
+	Developer string
+	Genres    []string
+	// 1 to 5, or 0 if not rated
+	Rating int
+	// nil if unknown
+	Played *bool
+	// marked as a favourite in the store
+	Favourite bool
+}
+
+// Steam Web API IPlayerService/GetOwnedGames response (with include_appinfo=1).
+// Developers, genres and favourites are not part of the response, but are read
+// if the file was extended with them, e.g. from the store API and the favorite
+// collection of the Steam client.
+type steamLibrary struct {
+	Response struct {
+		Games []*steamGame `json:"games"`
+	} `json:"response"`
+	Games []*steamGame `json:"games"`
+}
+
+type steamGame struct {
+	AppID           int      `json:"appid"`
+	Name            string   `json:"name"`
+	PlaytimeForever *int     `json:"playtime_forever"`
+	Developers      []string `json:"developers"`
+	Genres          []struct {
+		Description string `json:"description"`
+	} `json:"genres"`
+	Favorite bool `json:"favorite"`
+}
+
+// GOG account API getFilteredProducts response. Products refer to the user tags
+// by ID.
+type gogLibrary struct {
+	Products []*gogProduct `json:"products"`
+	Tags     []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"tags"`
+}
+
+type gogProduct struct {
+	ID        int64    `json:"id"`
+	Title     string   `json:"title"`
+	Category  string   `json:"category"`
+	Developer string   `json:"developer"`
+	Rating    int      `json:"rating"`
+	IsGame    *bool    `json:"isGame"`
+	Tags      []string `json:"tags"`
+}
+
+func readSteamLibrary(r io.Reader) ([]*LibraryGame, error) {
+	var library steamLibrary
+	if err := json.NewDecoder(r).Decode(&library); err != nil {
+		return nil, fmt.Errorf("failed to decode Steam library file: %v", err)
+	}
+	games := []*LibraryGame{}
+	for _, game := range append(library.Response.Games, library.Games...) {
+		libraryGame := &LibraryGame{
+			IDKey:     "steamAppId",
+			ID:        strconv.Itoa(game.AppID),
+			Title:     game.Name,
+			Platform:  "PC (Steam)",
+			Developer: strings.Join(game.Developers, ", "),
+			Favourite: game.Favorite,
+		}
+		for _, genre := range game.Genres {
+			libraryGame.Genres = append(libraryGame.Genres, genre.Description)
+		}
+		if game.PlaytimeForever != nil {
+			played := *game.PlaytimeForever > 0
+			libraryGame.Played = &played
+		}
+		games = append(games, libraryGame)
+	}
+	return games, nil
+}
+
+func readGOGLibrary(r io.Reader) ([]*LibraryGame, error) {
+	var library gogLibrary
+	if err := json.NewDecoder(r).Decode(&library); err != nil {
+		return nil, fmt.Errorf("failed to decode GOG library file: %v", err)
+	}
+	favouriteTags := map[string]bool{}
+	for _, tag := range library.Tags {
+		if _gogFavouriteTags[strings.ToLower(strings.TrimSpace(tag.Name))] {
+			favouriteTags[tag.ID] = true
+		}
+	}
+	games := []*LibraryGame{}
+	for _, product := range library.Products {
+		// movies and other products
+		if product.IsGame != nil && !*product.IsGame {
+			continue
+		}
+		game := &LibraryGame{
+			IDKey:     "gogId",
+			ID:        strconv.FormatInt(product.ID, 10),
+			Title:     product.Title,
+			Platform:  "PC (GOG)",
+			Developer: product.Developer,
+		}
+		if product.Category != "" {
+			game.Genres = []string{product.Category}
+		}
+		// ratings are either 1 to 5, or 10 to 50
+		if product.Rating >= 10 {
+			game.Rating = (product.Rating + 5) / 10
+		} else {
+			game.Rating = product.Rating
+		}
+		if game.Rating < 1 || game.Rating > 5 {
+			game.Rating = 0
+		}
+		for _, tag := range product.Tags {
+			game.Favourite = game.Favourite || favouriteTags[tag]
+		}
+		games = append(games, game)
+	}
+	return games, nil
+}
+
+// setupGameLibraryImport sets up the import of a library file of a game store
+// into the games type. Genres become tags, series are detected from titles, and
+// games that already exist, by title, are skipped and reported, so that games
+// owned in several stores can be consolidated.
+func setupGameLibraryImport(read func(io.Reader) ([]*LibraryGame, error)) func(*flag.FlagSet) func(io.Reader, *Importer) error {
+	return func(flags *flag.FlagSet) func(io.Reader, *Importer) error {
+		return func(r io.Reader, importer *Importer) error {
+			if !importer.db.enabledTypes.Contains("games") {
+				return fmt.Errorf("type %q is not enabled in the store file", "games")
+			}
+			games, err := read(r)
+			if err != nil {
+				return err
+			}
+
+			// titles that can be series of other games
+			known := map[string]bool{}
+			for _, item := range importer.db.items {
+				if item.Type == "games" {
+					known[identityValue(item.Metadata["series"])] = true
+					known[identityValue(item.Metadata["title"])] = true
+				}
+			}
+			for _, game := range games {
+				known[identityValue(game.Title)] = true
+			}
+			delete(known, "")
+
+			for i, game := range games {
+				importer.add(game.record(fmt.Sprintf("game %d (%s %s)", i+1, game.IDKey, game.ID), known))
+			}
+			return nil
+		}
+	}
+}
+
+// record converts the game to the metadata of the games type.
+func (g *LibraryGame) record(source string, known map[string]bool) *ImportRecord {
+	metadata := map[string]string{
+		"title":     strings.TrimSpace(g.Title),
+		"series":    detectSeries(strings.TrimSpace(g.Title), known),
+		"platform":  g.Platform,
+		"developer": g.Developer,
+		"category":  strings.Join(g.Genres, ", "),
+		g.IDKey:     g.ID,
+	}
+	if g.Rating > 0 {
+		metadata["rating"] = strconv.Itoa(g.Rating)
+	}
+	// games that were played are not necessarily completed
+	if g.Played != nil && !*g.Played {
+		metadata["completed"] = "No"
+	}
+	if g.Favourite {
+		metadata["star"] = "Yes"
+	}
+	tags := []string{}
+	for _, genre := range g.Genres {
+		if tag := tagFromName(genre); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	metadata[MKEY_TAGS] = strings.Join(tags, ",")
+
+	return &ImportRecord{
+		Source:   source,
+		Type:     "games",
+		Keys:     _gameKeys,
+		Metadata: metadata,
+		Identity: []string{"title"},
+	}
+}
+
+// detectSeries returns the series of the game, if the title ends with a sequel
+// number (e.g. "Portal 2" is in the "Portal" series, and "Heroes of Might and
+// Magic III" is in the "Heroes of Might and Magic" series, if it is known), or
+// if the title without the subtitle is a known series or title (e.g.
+// "Half-Life: Blue Shift" is in the "Half-Life" series, if "Half-Life" is
+// known). Otherwise, it returns "".
+func detectSeries(title string, known map[string]bool) string {
+	base, _, subtitled := strings.Cut(title, ":")
+	base = strings.TrimSpace(base)
+	if match := sequelRE.FindStringSubmatch(base); match != nil && (match[2] != "" || known[identityValue(match[1])]) {
+		return match[1]
+	}
+	if subtitled && known[identityValue(base)] {
+		return base
+	}
+	return ""
+}
@@ -3,7 +3,9 @@ package server
 import (
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 func multiHandler() http.Handler {
@@ -11,7 +13,7 @@ func multiHandler() http.Handler {
 	mux := http.NewServeMux()
 
 	register := func(p string, h func(http.ResponseWriter, *http.Request)) {
-		mux.HandleFunc(p, h)
+		mux.Handle(p, instrumented(p, http.HandlerFunc(h)))
 		trace(_https, "handler registered for pattern %s", p)
 	}
 
@@ -27,8 +29,43 @@ func multiHandler() http.Handler {
 	register("GET /items/{id}", renderItem)
 	// /items/{$} 404
 
+	register("GET /export.csv", serveExport(EXPORT_CSV, "text/csv; charset=utf-8"))
+	register("GET /export.json", serveExport(EXPORT_JSON, "application/json"))
+
+	registerAPI := func(p string, scope string, h func(http.ResponseWriter, *http.Request)) {
+		register(p, requireScope(scope, h))
+	}
+
+	registerAPI("GET /api/v1/items", SCOPE_READ, serveAPIItems)
+	registerAPI("GET /api/v1/items/{id}", SCOPE_READ, serveAPIItem)
+	registerAPI("PUT /api/v1/items/{id}", SCOPE_WRITE, handleAPIItemUpdate)
+	registerAPI("GET /api/v1/collections", SCOPE_READ, serveAPICollections)
+	registerAPI("GET /api/v1/tags", SCOPE_READ, serveAPITags)
+
+	if _auth != nil && len(_auth.users) > 0 {
+		register("GET /login", renderLogin)
+		register("POST /login", handleLogin)
+		register("GET /logout", renderLogout)
+		register("POST /logout", handleLogout)
+	}
+	if _auth != nil {
+		register("GET /dupes", requireAdmin(renderDupes))
+		register("GET /items/{id}/history", requireAdmin(renderItemHistory))
+		register("POST /items/{id}/history/revert", requireAdmin(handleItemRevert))
+		register("GET /items/{id}/delete", requireAdmin(renderItemDelete))
+		register("POST /items/{id}/delete", requireAdmin(handleItemDelete))
+		register("GET /trash", requireAdmin(renderTrash))
+		register("POST /trash/{id}/restore", requireAdmin(handleTrashRestore))
+		register("POST /trash/{id}/purge", requireAdmin(handleTrashPurge))
+	}
+
+	register("GET /healthz", serveHealth)
+	register("GET /readyz", serveReadiness)
+	register("GET /version", serveVersion)
+	register("GET /metrics", serveMetrics)
+
 	// static file server
-	mux.Handle("GET /static/", http.StripPrefix("/static/", _fileServer))
+	mux.Handle("GET /static/", instrumented("GET /static/", http.StripPrefix("/static/", _fileServer)))
 	trace(_https, "static file server registered for tree /static/")
 
 	register("GET /", defaultHandler)
@@ -45,7 +82,7 @@ func defaultHandler(w http.ResponseWriter, r *http.Request) {
 			icon *os.File
 			fi   os.FileInfo
 		)
-		icon, err := os.Open("data/static/favicon.ico")
+		icon, err := os.Open(filepath.Join(_staticDir, "favicon.ico"))
 		if err == nil {
 			fi, err = icon.Stat()
 		}
@@ -53,6 +90,7 @@ func defaultHandler(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		defer icon.Close()
 		http.ServeContent(w, r, "favicon.ico", fi.ModTime(), icon)
 	default:
 		renderNotFound(w, "Page not found.")
@@ -60,89 +98,108 @@ func defaultHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func renderCollections(w http.ResponseWriter, r *http.Request) {
-	render(
-		w,
+	view := currentDatabase().view(audienceOf(r))
+	renderCached(
+		w, r, view,
 		HTMLPage{
 			Key:        "@collections",
 			Supertitle: "All",
 			Title:      "Collections",
-			Data:       NewCollectionMap(_database.collections()),
+			Data:       NewCollectionMap(view.collections()),
 		},
 	)
 }
 
 func renderCollection(w http.ResponseWriter, r *http.Request) {
+	view := currentDatabase().view(audienceOf(r))
 	collectionKey := r.PathValue("collection")
-	catalogue := _database.catalogueForCollection(collectionKey)
+	catalogue := view.catalogueForCollection(collectionKey)
 	if catalogue == nil {
 		renderNotFound(w, "Collection not found.")
 		return
 	}
 
-	render(
-		w,
+	renderCached(
+		w, r, view,
 		HTMLPage{
 			Key:        "@catalogue",
 			Supertitle: "Collection",
-			Title:      _database.declaredCollections[collectionKey],
+			Title:      view.db.declaredCollections[collectionKey],
 			Data:       catalogue,
 		},
 	)
 }
 
 func renderTags(w http.ResponseWriter, r *http.Request) {
-	render(
-		w,
+	view := currentDatabase().view(audienceOf(r))
+	renderCached(
+		w, r, view,
 		HTMLPage{
 			Key:        "@tags",
 			Supertitle: "All",
 			Title:      "Tags",
-			Data:       NewTagMap(_database.tags()),
+			Data:       NewTagMap(view.tags()),
 		},
 	)
 }
 
 func renderTag(w http.ResponseWriter, r *http.Request) {
+	view := currentDatabase().view(audienceOf(r))
 	tag := r.PathValue("tag")
-	catalogue := _database.catalogueOfTaggedItems(tag)
+	catalogue := view.catalogueOfTaggedItems(tag)
 	if catalogue == nil {
 		renderNotFound(w, "Tag not found.")
 		return
 	}
 
-	render(
-		w,
+	renderCached(
+		w, r, view,
 		HTMLPage{
 			Key:        "@catalogue",
 			Supertitle: "Items tagged with",
 			Title:      tag,
-			Data:       catalogue.withHiddenTags(),
+			Data:       catalogue,
 		},
 	)
 }
 
 func renderItems(w http.ResponseWriter, r *http.Request) {
-	render(
-		w,
+	view := currentDatabase().view(audienceOf(r))
+	catalogue := view.catalogueOfEverything()
+	if catalogue == nil {
+		renderNotFound(w, "No items found.")
+		return
+	}
+
+	renderCached(
+		w, r, view,
 		HTMLPage{
 			Key:        "@catalogue",
 			Supertitle: "All",
 			Title:      "Items",
-			Data:       _database.catalogueOfEverything().withHiddenTags(),
+			Data:       catalogue,
 		},
 	)
 }
 
 func renderItem(w http.ResponseWriter, r *http.Request) {
+	view := currentDatabase().view(audienceOf(r))
 	itemID, err := strconv.Atoi(r.PathValue("id"))
-	if err != nil || itemID < 0 || itemID > _database.lastID() {
+	if err != nil {
+		renderNotFound(w, "Item not found.")
+		return
+	}
+	if redirectToCanonicalItem(w, r, itemID) {
+		return
+	}
+	item := view.singleItem(itemID)
+	if item == nil {
 		renderNotFound(w, "Item not found.")
 		return
 	}
 
-	item := _database.singleItem(itemID)
-	render(
-		w,
+	renderCached(
+		w, r, view,
 		HTMLPage{
 			Key:        "@" + item.Type + "/item",
 			Supertitle: TypeLabel(item.Type),
@@ -152,9 +209,23 @@ func renderItem(w http.ResponseWriter, r *http.Request) {
 	)
 }
 
+// redirectToCanonicalItem redirects requests for items with IDs that are not in
+// the canonical form, e.g. /items/01 or /items/+1, to /items/1, so that every
+// item page is cached only once. It reports whether the request was redirected.
+func redirectToCanonicalItem(w http.ResponseWriter, r *http.Request, itemID int) bool {
+	id := r.PathValue("id")
+	if canonical := strconv.Itoa(itemID); id != canonical {
+		i := strings.LastIndex(r.URL.Path, id)
+		http.Redirect(w, r, r.URL.Path[:i]+canonical+r.URL.Path[i+len(id):], http.StatusMovedPermanently)
+		return true
+	}
+	return false
+}
+
 func renderNotFound(w http.ResponseWriter, message string) {
 	render(
 		w,
+		http.StatusNotFound,
 		HTMLPage{
 			Key:          "@not-found",
 			Supertitle:   "404",
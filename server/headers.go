@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Security headers sent with every response, set up by configure.
+var _securityHeaders = http.Header{}
+
+// newSecurityHeaders builds the security headers from the configuration.
+// Inline styles of the templates are allowed by their hashes, since pages are
+// cached and cannot carry a per-response nonce. HSTS is sent only over TLS.
+func newSecurityHeaders(config HeadersConfig, styleHashes []string, tls bool) http.Header {
+	headers := http.Header{}
+
+	if policy := strings.TrimSpace(config.ContentSecurityPolicy); policy != "" {
+		directives := []string{strings.TrimSuffix(policy, ";")}
+		if !hasDirective(policy, "style-src") {
+			sources := []string{"'self'"}
+			for _, hash := range styleHashes {
+				sources = append(sources, "'"+hash+"'")
+			}
+			directives = append(directives, "style-src "+strings.Join(sources, " "))
+		}
+		if config.FrameAncestors != "" && !hasDirective(policy, "frame-ancestors") {
+			directives = append(directives, "frame-ancestors "+config.FrameAncestors)
+		}
+		headers.Set("Content-Security-Policy", strings.Join(directives, "; "))
+	}
+
+	// for browsers that do not support frame-ancestors
+	switch config.FrameAncestors {
+	case "'none'":
+		headers.Set("X-Frame-Options", "DENY")
+	case "'self'":
+		headers.Set("X-Frame-Options", "SAMEORIGIN")
+	}
+
+	if config.ContentTypeOptions {
+		headers.Set("X-Content-Type-Options", "nosniff")
+	}
+	if config.ReferrerPolicy != "" {
+		headers.Set("Referrer-Policy", config.ReferrerPolicy)
+	}
+	if tls && config.HSTSMaxAge > 0 {
+		hsts := fmt.Sprintf("max-age=%d", int64(time.Duration(config.HSTSMaxAge).Seconds()))
+		if config.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		headers.Set("Strict-Transport-Security", hsts)
+	}
+
+	return headers
+}
+
+func hasDirective(policy string, name string) bool {
+	for _, directive := range strings.Split(policy, ";") {
+		if fields := strings.Fields(directive); len(fields) > 0 && strings.EqualFold(fields[0], name) {
+			return true
+		}
+	}
+	return false
+}
+
+// securityHeaders adds the security headers to every response.
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key, values := range _securityHeaders {
+			w.Header()[key] = values
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// inlineStyleHashes returns CSP hashes ("sha256-...") of the content of every
+// <style> element produced by the template. The template must not depend on
+// anything other than data, which is fixed after the templates are loaded.
+func inlineStyleHashes(t *template.Template, name string, data any) ([]string, error) {
+	buf := &bytes.Buffer{}
+	if err := t.ExecuteTemplate(buf, name, data); err != nil {
+		return nil, fmt.Errorf("failed to render template %s: %v", name, err)
+	}
+	hashes := []string{}
+	content := buf.String()
+	for {
+		start := strings.Index(content, "<style")
+		if start < 0 {
+			break
+		}
+		content = content[start:]
+		open := strings.Index(content, ">")
+		end := strings.Index(content, "</style>")
+		if open < 0 || end < open {
+			return nil, fmt.Errorf("template %s: unterminated <style> element", name)
+		}
+		sum := sha256.Sum256([]byte(content[open+1 : end]))
+		hashes = append(hashes, "sha256-"+base64.StdEncoding.EncodeToString(sum[:]))
+		content = content[end:]
+	}
+	return hashes, nil
+}
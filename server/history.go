@@ -0,0 +1,443 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// History actions.
+const (
+	HISTORY_CREATE  = "create"
+	HISTORY_UPDATE  = "update"
+	HISTORY_DELETE  = "delete"
+	HISTORY_RESTORE = "restore"
+	HISTORY_PURGE   = "purge"
+)
+
+// HistoryEntry is a change of an item, as recorded in the history log. Before
+// and After hold the attributes of the item element in the store file, so
+// they do not include defaults. Before is nil for created items, and After
+// is nil for deleted and purged items. Items in the trash have no ID, so
+// restored items have their new ID, and purged items have -1.
+type HistoryEntry struct {
+	Time   time.Time         `json:"time"`
+	User   string            `json:"user"`
+	Action string            `json:"action"`
+	Type   string            `json:"type"`
+	ID     int               `json:"id"`
+	UID    string            `json:"uid"`
+	Before map[string]string `json:"before,omitempty"`
+	After  map[string]string `json:"after,omitempty"`
+	// version of the item that it was reverted to, if it was
+	Reverted int `json:"reverted,omitempty"`
+}
+
+var (
+	errStoreChanged = errors.New("store file was changed in the meantime, reload and try again")
+	errItemNotFound = errors.New("item not found")
+)
+
+// errInvalidItem wraps errors caused by metadata that does not pass validation.
+type errInvalidItem struct {
+	error
+}
+
+// Serializes changes of the store file made by the server.
+var _storeLock sync.Mutex
+
+// drainStoreChanges waits for changes of the store file that are in progress,
+// and keeps further ones from starting, so that the process does not exit
+// between writing the store file and its history log. It is a shutdown hook.
+func drainStoreChanges() error {
+	_storeLock.Lock()
+	traceDebug(_control, "main: shutdown: store file changes drained")
+	return nil
+}
+
+// historyPath returns the path of the history log kept beside the store file,
+// e.g. store/koidata.history.jsonl for store/koidata.xml.
+func historyPath(storePath string) string {
+	return strings.TrimSuffix(storePath, filepath.Ext(storePath)) + ".history.jsonl"
+}
+
+// appendHistory appends the entries to the history log of the store file, one
+// JSON object per line. The log is never rewritten, only appended to.
+func appendHistory(storePath string, entries ...*HistoryEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(storePath); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	buf := &bytes.Buffer{}
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode history entry: %v", err)
+		}
+		buf.Write(append(line, '\n'))
+	}
+	file, err := os.OpenFile(historyPath(storePath), os.O_WRONLY|os.O_APPEND|os.O_CREATE, perm)
+	if err != nil {
+		return fmt.Errorf("failed to open history log: %v", err)
+	}
+	defer file.Close()
+	if _, err = file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write history log: %v", err)
+	}
+	return nil
+}
+
+// itemHistory returns the entries of the item with the persistent ID, oldest first.
+func itemHistory(storePath string, uid string) ([]*HistoryEntry, error) {
+	entries := []*HistoryEntry{}
+	file, err := os.Open(historyPath(storePath))
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history log: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	for line := 1; scanner.Scan(); line++ {
+		entry := &HistoryEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			traceWarning(_https, "history log line %d: %v", line, err)
+			continue
+		}
+		if entry.UID == uid {
+			entries = append(entries, entry)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history log: %v", err)
+	}
+	return entries, nil
+}
+
+// newUID returns a random persistent ID for an item, see MKEY_UID.
+func newUID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// commandUser returns the name recorded in the history log for changes made by commands.
+func commandUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	return "unknown"
+}
+
+// orderedAttrs returns the metadata as attributes, in the order of the existing
+// attributes, followed by new ones in alphabetical order. Empty values are left out.
+func orderedAttrs(existing []xml.Attr, metadata map[string]string) []xml.Attr {
+	attrs := []xml.Attr{}
+	written := map[string]bool{}
+	for _, attr := range existing {
+		key := attr.Name.Local
+		if value := metadata[key]; value != "" && !written[key] {
+			attrs = append(attrs, xml.Attr{Name: xml.Name{Local: key}, Value: value})
+			written[key] = true
+		}
+	}
+	added := []string{}
+	for key, value := range metadata {
+		if value != "" && !written[key] {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(added)
+	for _, key := range added {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: key}, Value: metadata[key]})
+	}
+	return attrs
+}
+
+// changeStore applies a change to the store file of the Database, records it in the
+// history log, and replaces the global Database with the reloaded one, which is
+// returned. The change gets the content of the store file, its item elements and
+// the elements of items in the trash (see scanItems), and returns the new content and the entries describing it.
+// If the store file no longer matches the Database, errStoreChanged is returned.
+func changeStore(db *Database, change func(content []byte, items []*storeItem, trashed []*storeItem) ([]byte, []*HistoryEntry, error)) (*Database, error) {
+	_storeLock.Lock()
+	defer _storeLock.Unlock()
+
+	fi, err := os.Stat(db.filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat store file: %v", err)
+	}
+	content, err := os.ReadFile(db.filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store file: %v", err)
+	}
+	if hash := sha256.Sum256(content); hex.EncodeToString(hash[:])[:16] != db.version {
+		return nil, errStoreChanged
+	}
+	items, trashed, err := scanItems(content, db.enabledTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	content, entries, err := change(content, items, trashed)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeStore(db.filePath, content, fi.ModTime()); err != nil {
+		return nil, err
+	}
+	if err = appendHistory(db.filePath, entries...); err != nil {
+		// the change is already written, and it is not undone
+		traceError(_https, "history: %v", err)
+	}
+
+	reloaded, err := loadDatabase(db.filePath)
+	if err != nil {
+		_metrics.reloadFailures.Add(1)
+		_storeStale.Store(true)
+		return nil, err
+	}
+	_database.Store(reloaded)
+	_storeStale.Store(false)
+	trace(_decoder, "database reloaded after a change, %d items", len(reloaded.items))
+	return reloaded, nil
+}
+
+// updateItem replaces the metadata of the item in the store file on behalf of
+// the user, and assigns it a persistent ID if it does not have one yet.
+func updateItem(db *Database, id int, metadata map[string]string, user string, reverted int) (*Database, error) {
+	return changeStore(db, func(content []byte, items []*storeItem, _ []*storeItem) ([]byte, []*HistoryEntry, error) {
+		if id < 0 || id >= len(items) {
+			return nil, nil, errItemNotFound
+		}
+		element := items[id]
+		before := element.metadata()
+
+		after := make(map[string]string, len(metadata)+1)
+		for key, value := range metadata {
+			// the server maintains these, sending them back unchanged is fine
+			if (key == MKEY_UID || key == MKEY_DELETED) && value != "" && value != before[key] {
+				return nil, nil, errInvalidItem{fmt.Errorf("%s cannot be changed", key)}
+			}
+			after[key] = value
+		}
+		if after[MKEY_UID] = before[MKEY_UID]; after[MKEY_UID] == "" {
+			after[MKEY_UID] = newUID()
+		}
+		if err := db.validateItem(element.typeKey, withoutEmptyValues(after)); err != nil {
+			return nil, nil, errInvalidItem{err}
+		}
+
+		attrs := orderedAttrs(element.attrs, after)
+		content, err := replaceInStore(content, element, attrs, time.Now())
+		if err != nil {
+			return nil, nil, err
+		}
+		return content, []*HistoryEntry{{
+			Time:     time.Now().UTC(),
+			User:     user,
+			Action:   HISTORY_UPDATE,
+			Type:     element.typeKey,
+			ID:       id,
+			UID:      after[MKEY_UID],
+			Before:   before,
+			After:    (&storeItem{attrs: attrs}).metadata(),
+			Reverted: reverted,
+		}}, nil
+	})
+}
+
+func withoutEmptyValues(metadata map[string]string) map[string]string {
+	result := map[string]string{}
+	for key, value := range metadata {
+		if value != "" {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// ItemHistory is the history of an item, newest version first.
+//
+// ItemHistory implements DataObjectInterface.
+type ItemHistory struct {
+	CommonBaseObject
+
+	Item     *Item
+	Versions []*ItemVersion
+}
+
+// ItemVersion is a version of an item, as rendered on the history page.
+type ItemVersion struct {
+	Number     int
+	Time       string
+	User       string
+	Action     string
+	Reverted   int
+	Changes    []*ValueChange
+	Revertible bool
+}
+
+// Ref implements DataObjectInterface.
+func (h *ItemHistory) Ref() any {
+	return h
+}
+
+// HideTags implements DataObjectInterface.
+func (*ItemHistory) HideTags() bool {
+	return true
+}
+
+// newItemHistory converts the entries, current being the attributes of the item
+// element in the store file, which differ from the latest version if the file
+// was edited by hand.
+func newItemHistory(item *Item, entries []*HistoryEntry, current map[string]string) *ItemHistory {
+	history := &ItemHistory{Item: item, Versions: []*ItemVersion{}}
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		history.Versions = append(history.Versions, &ItemVersion{
+			Number:     i + 1,
+			Time:       entry.Time.Local().Format("2006-01-02 15:04:05"),
+			User:       entry.User,
+			Action:     entry.Action,
+			Reverted:   entry.Reverted,
+			Changes:    diffMaps(entry.Before, entry.After),
+			Revertible: entry.After != nil && !maps.Equal(entry.After, current),
+		})
+	}
+	return history
+}
+
+// historyOf returns the item with the ID in the path, its history, and the
+// attributes of its element in the store file.
+func historyOf(db *Database, r *http.Request) (*Item, []*HistoryEntry, map[string]string, error) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return nil, nil, nil, errItemNotFound
+	}
+	item := db.view(AUDIENCE_AUTHENTICATED).singleItem(id)
+	if item == nil {
+		return nil, nil, nil, errItemNotFound
+	}
+	// items get a persistent ID when they are first changed
+	uid := item.Metadata[MKEY_UID]
+	if uid == "" {
+		return item, []*HistoryEntry{}, nil, nil
+	}
+	entries, err := itemHistory(db.filePath, uid)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	content, err := os.ReadFile(db.filePath)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read store file: %v", err)
+	}
+	elements, _, err := scanItems(content, db.enabledTypes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, element := range elements {
+		if metadata := element.metadata(); metadata[MKEY_UID] == uid {
+			return item, entries, metadata, nil
+		}
+	}
+	return item, entries, nil, nil
+}
+
+// renderItemHistory handles /items/{id}/history. The page is not cached,
+// since it embeds the CSRF token used by revert forms.
+func renderItemHistory(w http.ResponseWriter, r *http.Request) {
+	item, entries, current, err := historyOf(currentDatabase(), r)
+	if errors.Is(err, errItemNotFound) {
+		renderNotFound(w, "Item not found.")
+		return
+	}
+	if err != nil {
+		traceError(_https, "history: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	render(
+		w,
+		http.StatusOK,
+		HTMLPage{
+			Key:        "@history",
+			Supertitle: TypeLabel(item.Type),
+			Title:      item.Label,
+			CSRFToken:  csrfToken(w, r),
+			Admin:      true,
+			Data:       newItemHistory(item, entries, current),
+		},
+	)
+}
+
+// handleItemRevert handles reverting of an item to the version in the form.
+func handleItemRevert(w http.ResponseWriter, r *http.Request) {
+	db := currentDatabase()
+	item, entries, current, err := historyOf(db, r)
+	if errors.Is(err, errItemNotFound) {
+		renderNotFound(w, "Item not found.")
+		return
+	}
+	if err != nil {
+		traceError(_https, "history: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	version, err := strconv.Atoi(r.PostFormValue("version"))
+	if err != nil || version < 1 || version > len(entries) || entries[version-1].After == nil {
+		http.Error(w, "Invalid version.", http.StatusBadRequest)
+		return
+	}
+	if maps.Equal(entries[version-1].After, current) {
+		// already reverted, e.g. the form was submitted twice
+		http.Redirect(w, r, fmt.Sprintf("/items/%d/history", item.ID), http.StatusSeeOther)
+		return
+	}
+	if !checkFormRevision(w, r, db, item) {
+		return
+	}
+
+	_, err = updateItem(db, item.ID, entries[version-1].After, requestUser(r), version)
+	switch {
+	case errors.Is(err, errStoreChanged):
+		http.Error(w, "The store file was changed in the meantime, reload the page and try again.", http.StatusConflict)
+		return
+	case errors.Is(err, errItemNotFound):
+		renderNotFound(w, "Item not found.")
+		return
+	case errors.As(err, &errInvalidItem{}):
+		http.Error(w, fmt.Sprintf("The version cannot be restored: %v.", err), http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		traceError(_https, "revert item %d: %v", item.ID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	trace(_https, "user %q reverted item %d to version %d", requestUser(r), item.ID, version)
+	http.Redirect(w, r, fmt.Sprintf("/items/%d/history", item.ID), http.StatusSeeOther)
+}
@@ -0,0 +1,348 @@
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ImportRecord is an item read from an import source.
+type ImportRecord struct {
+	// position in the source, used in reports, e.g. "line 5"
+	Source string
+	Type   string
+	// metadata keys in the order in which they are written to the store file
+	Keys     []string
+	Metadata map[string]string
+	// metadata keys identifying the item, used to detect duplicates, see identityValue
+	Identity []string
+}
+
+// ImportFormat is a source format of the import command.
+type ImportFormat struct {
+	Summary string
+	// Setup registers flags specific to the format, and returns the function
+	// that reads records from the source and passes them to the importer.
+	Setup func(flags *flag.FlagSet) func(r io.Reader, importer *Importer) error
+}
+
+// Set up in init, see _commands.
+var _importFormats map[string]*ImportFormat
+
+func init() {
+	_importFormats = map[string]*ImportFormat{
+		"csv": {
+			Summary: "spreadsheet with a header row, columns are mapped to metadata keys",
+			Setup:   setupCSVImport,
+		},
+		"goodreads": {
+			Summary: "Goodreads library export (CSV) into books, shelves become tags",
+			Setup:   setupLibraryImport(_goodreads),
+		},
+		"storygraph": {
+			Summary: "StoryGraph library export (CSV) into books, tags and read status become tags",
+			Setup:   setupLibraryImport(_storygraph),
+		},
+		"bgg": {
+			Summary: "BoardGameGeek collection or thing response (XML, saved to a file) into boardgames",
+			Setup:   setupBGGImport,
+		},
+		"steam": {
+			Summary: "Steam owned games (JSON, GetOwnedGames response saved to a file) into games",
+			Setup:   setupGameLibraryImport(readSteamLibrary),
+		},
+		"gog": {
+			Summary: "GOG owned products (JSON, getFilteredProducts response saved to a file) into games",
+			Setup:   setupGameLibraryImport(readGOGLibrary),
+		},
+	}
+}
+
+// Importer validates records read from an import source against the store file,
+// and appends the valid ones to it. By default, nothing is written if any record
+// is rejected, so that the import can be fixed and repeated without duplicates.
+type Importer struct {
+	storePath   string
+	dryRun      bool
+	skipInvalid bool
+
+	db       *Database
+	content  []byte
+	modTime  time.Time
+	accepted []*ImportRecord
+	rejected int
+	skipped  int
+}
+
+func newImporter(storePath string, dryRun bool, skipInvalid bool) (*Importer, error) {
+	fi, err := os.Stat(storePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat store file: %v", err)
+	}
+	content, err := os.ReadFile(storePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store file: %v", err)
+	}
+	db, err := DecodeDatabase(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode store file %s: %v", storePath, err)
+	}
+	return &Importer{
+		storePath:   storePath,
+		dryRun:      dryRun,
+		skipInvalid: skipInvalid,
+		db:          db,
+		content:     content,
+		modTime:     fi.ModTime(),
+	}, nil
+}
+
+// add validates the record, and reports it if it is rejected or skipped as a duplicate.
+func (im *Importer) add(record *ImportRecord) {
+	for _, key := range []string{MKEY_TAGS, MKEY_COLLECTIONS} {
+		if value, found := record.Metadata[key]; found {
+			record.Metadata[key] = normalizeList(value)
+		}
+	}
+	for _, key := range record.Keys {
+		if record.Metadata[key] == "" {
+			delete(record.Metadata, key)
+		}
+	}
+	if err := im.db.validateItem(record.Type, record.Metadata); err != nil {
+		im.reject(record.Source, err)
+		return
+	}
+	if duplicate := im.duplicate(record); duplicate != "" {
+		im.skip(record.Source, "duplicate of "+duplicate)
+		return
+	}
+	im.accepted = append(im.accepted, record)
+}
+
+// reject reports a record that could not be read or is not valid.
+func (im *Importer) reject(source string, err error) {
+	im.rejected++
+	fmt.Fprintf(os.Stderr, "%s: rejected: %v\n", source, err)
+}
+
+// skip reports a record that is valid, but is not imported.
+func (im *Importer) skip(source string, reason string) {
+	im.skipped++
+	fmt.Fprintf(os.Stderr, "%s: skipped: %s\n", source, reason)
+}
+
+// duplicate describes the existing item or the accepted record of the same type
+// with the same identity as the record, or returns "" if there is none.
+// Records with an incomplete identity are never duplicates.
+func (im *Importer) duplicate(record *ImportRecord) string {
+	identity := make([]string, len(record.Identity))
+	for i, key := range record.Identity {
+		if identity[i] = identityValue(record.Metadata[key]); identity[i] == "" {
+			return ""
+		}
+	}
+	if len(identity) == 0 {
+		return ""
+	}
+	matches := func(typeKey string, metadata map[string]string) bool {
+		if typeKey != record.Type {
+			return false
+		}
+		for i, key := range record.Identity {
+			if identityValue(metadata[key]) != identity[i] {
+				return false
+			}
+		}
+		return true
+	}
+	for _, item := range im.db.items {
+		if matches(item.Type, item.Metadata) {
+			return fmt.Sprintf("item %d %q", item.ID, item.Label)
+		}
+	}
+	for _, other := range im.accepted {
+		if matches(other.Type, other.Metadata) {
+			return other.Source
+		}
+	}
+	return ""
+}
+
+// identityValue normalizes the value for comparison, ignoring case,
+// punctuation and spacing, e.g. "The Hobbit" and "the hobbit." are equal.
+func identityValue(value string) string {
+	words := strings.FieldsFunc(strings.ToLower(value), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
+
+// commit appends accepted records to the store file, unless this is a dry run.
+func (im *Importer) commit() error {
+	verb := "imported"
+	if im.dryRun {
+		verb = "would be imported"
+	}
+	if im.rejected > 0 && !im.skipInvalid {
+		fmt.Printf("%d items accepted, %d rejected, %d skipped, nothing %s\n", len(im.accepted), im.rejected, im.skipped, verb)
+		return fmt.Errorf("%d records rejected, fix them or use -skip-invalid", im.rejected)
+	}
+	fmt.Printf("%d items %s, %d rejected, %d skipped\n", len(im.accepted), verb, im.rejected, im.skipped)
+	if im.dryRun || len(im.accepted) == 0 {
+		return nil
+	}
+
+	// items are appended by type, in the order in which they were read,
+	// with persistent IDs, so that their history can be followed
+	types := []string{}
+	byType := map[string][][]xml.Attr{}
+	for _, record := range im.accepted {
+		if _, found := byType[record.Type]; !found {
+			types = append(types, record.Type)
+		}
+		if record.Metadata[MKEY_UID] == "" {
+			record.Metadata[MKEY_UID] = newUID()
+			record.Keys = append(record.Keys[:len(record.Keys):len(record.Keys)], MKEY_UID)
+		}
+		attrs := []xml.Attr{}
+		for _, key := range record.Keys {
+			if value, found := record.Metadata[key]; found {
+				attrs = append(attrs, xml.Attr{Name: xml.Name{Local: key}, Value: value})
+			}
+		}
+		byType[record.Type] = append(byType[record.Type], attrs)
+	}
+	content := im.content
+	for _, typeKey := range types {
+		var err error
+		if content, err = appendToStore(content, typeKey, byType[typeKey], time.Now()); err != nil {
+			return err
+		}
+	}
+	if err := writeStore(im.storePath, content, im.modTime); err != nil {
+		return err
+	}
+	return im.recordHistory(content)
+}
+
+// recordHistory records imported items as created in the history log, with the
+// attributes of their elements as written to the store file.
+func (im *Importer) recordHistory(content []byte) error {
+	items, _, err := scanItems(content, im.db.enabledTypes)
+	if err != nil {
+		return err
+	}
+	ids := map[string]int{}
+	for id, item := range items {
+		if uid := item.metadata()[MKEY_UID]; uid != "" {
+			ids[uid] = id
+		}
+	}
+	now, user := time.Now().UTC(), commandUser()
+	entries := make([]*HistoryEntry, len(im.accepted))
+	for i, record := range im.accepted {
+		uid := record.Metadata[MKEY_UID]
+		id, found := ids[uid]
+		if !found {
+			return fmt.Errorf("imported item %s not found in the store file", uid)
+		}
+		entries[i] = &HistoryEntry{
+			Time:   now,
+			User:   user,
+			Action: HISTORY_CREATE,
+			Type:   record.Type,
+			ID:     id,
+			UID:    uid,
+			After:  items[id].metadata(),
+		}
+	}
+	return appendHistory(im.storePath, entries...)
+}
+
+// writeStore replaces the store file, unless it was modified after it was read
+// at modTime, in which case changes made in the meantime would be lost.
+func writeStore(path string, content []byte, modTime time.Time) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat store file: %v", err)
+	}
+	if !fi.ModTime().Equal(modTime) {
+		return errors.New("store file was modified in the meantime, nothing was written")
+	}
+	return writeFileAtomically(path, content, fi.Mode().Perm())
+}
+
+// normalizeList trims elements of a comma-separated list, and drops empty ones.
+func normalizeList(value string) string {
+	elements := []string{}
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return strings.Join(elements, ",")
+}
+
+func runImportCommand(args []string) error {
+	formats := make([]string, 0, len(_importFormats))
+	for name := range _importFormats {
+		formats = append(formats, name)
+	}
+	sort.Strings(formats)
+	usage := errUsage{fmt.Errorf("expected source format: %s", strings.Join(formats, ", "))}
+	if len(args) == 0 {
+		return usage
+	}
+	format, found := _importFormats[args[0]]
+	if !found {
+		return usage
+	}
+
+	flags, readConfig := newCommandFlags("import " + args[0])
+	storePath := flags.String("store", "", "path to the XML database `file` (default from configuration)")
+	dryRun := flags.Bool("dry-run", false, "validate and report, without writing the store file")
+	skipInvalid := flags.Bool("skip-invalid", false, "import valid records even if some are rejected")
+	read := format.Setup(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [flags] file\n\n%s, use - for stdin.\n\nFlags:\n", flags.Name(), format.Summary)
+		flags.PrintDefaults()
+	}
+	if err := parseFlags(flags, args[1:], 1); err != nil {
+		return err
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if *storePath != "" {
+		config.Store = *storePath
+	}
+	importer, err := newImporter(config.Store, *dryRun, *skipInvalid)
+	if err != nil {
+		return err
+	}
+
+	source := io.Reader(os.Stdin)
+	if name := flags.Arg(0); name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		source = file
+	}
+	if err = read(source, importer); err != nil {
+		return err
+	}
+	return importer.commit()
+}
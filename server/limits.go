@@ -0,0 +1,164 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets of clients that have not made a request for this long are dropped.
+const rateLimiterIdleTimeout = 10 * time.Minute
+
+// Paths that are never rate limited, since they are polled by the service
+// manager or the monitoring system from a single address.
+var _rateLimitExempt = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// RateLimiter limits the rate of requests per client address, using a token
+// bucket per address. Each bucket holds at most burst tokens, and is refilled
+// with rate tokens per second. A request takes one token, or is rejected if the
+// bucket is empty.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	lock        sync.Mutex
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Global rate limiter, nil if rate limiting is not enabled.
+var _rateLimiter *RateLimiter
+
+func newRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:        rate,
+		burst:       float64(burst),
+		buckets:     map[string]*bucket{},
+		lastCleanup: time.Now(),
+	}
+}
+
+// allow takes a token from the client's bucket. If the bucket is empty, it
+// returns false and the time after which the next token will be available.
+func (l *RateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.lastCleanup) > rateLimiterIdleTimeout {
+		for key, b := range l.buckets {
+			if now.Sub(b.updated) > rateLimiterIdleTimeout {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastCleanup = now
+	}
+
+	b := l.buckets[client]
+	if b == nil {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[client] = b
+	} else {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+		b.updated = now
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// rateLimiting rejects requests with 429 Too Many Requests when the client
+// exceeds its rate, see RateLimiter.
+func rateLimiting(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _rateLimiter == nil || _rateLimitExempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if allowed, wait := _rateLimiter.allow(clientAddress(r), time.Now()); !allowed {
+			_metrics.rateLimited.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests.", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Maximum size of request bodies, in bytes, 0 if not limited.
+var _maxBodyBytes int64
+
+// bodyLimiting limits the size of request bodies. Handlers reading a body
+// larger than the limit get an error, and the connection is closed.
+func bodyLimiting(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _maxBodyBytes > 0 && r.Body != nil {
+			if r.ContentLength > _maxBodyBytes {
+				http.Error(w, "Request body too large.", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, _maxBodyBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Networks of reverse proxies whose X-Forwarded-For headers are trusted.
+var _trustedProxies = mustParseNetworks(defaultConfig().TrustedProxies)
+
+// parseNetworks parses CIDR notations and single IP addresses.
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", value)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func mustParseNetworks(values []string) []*net.IPNet {
+	networks, err := parseNetworks(values)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range _trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of request duration histogram buckets, in seconds.
+var _durationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics collects counters exposed in the Prometheus text format on /metrics.
+// Database metrics are not collected, but read from the current Database.
+type Metrics struct {
+	lock      sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[string]*histogram
+
+	renderErrors   atomic.Uint64
+	reloadFailures atomic.Uint64
+	rateLimited    atomic.Uint64
+}
+
+type requestKey struct {
+	pattern string
+	code    int
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// Global metrics.
+var _metrics = &Metrics{
+	requests:  map[requestKey]uint64{},
+	durations: map[string]*histogram{},
+}
+
+func (m *Metrics) observeRequest(pattern string, code int, duration time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.requests[requestKey{pattern, code}]++
+
+	h := m.durations[pattern]
+	if h == nil {
+		h = &histogram{buckets: make([]uint64, len(_durationBuckets))}
+		m.durations[pattern] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range _durationBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// instrumented wraps the handler registered for the pattern, so that
+// its requests are counted and timed.
+func instrumented(pattern string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		_metrics.observeRequest(pattern, rec.status, time.Since(start))
+	})
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	var view *View
+	if db := currentDatabase(); db != nil {
+		view = db.view(audienceOf(r))
+	}
+	_metrics.write(w, view)
+}
+
+// snapshot copies the request counters and histograms, so that they can be
+// written without holding the lock that every request takes.
+func (m *Metrics) snapshot() (map[requestKey]uint64, map[string]*histogram) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	requests := make(map[requestKey]uint64, len(m.requests))
+	for key, count := range m.requests {
+		requests[key] = count
+	}
+	durations := make(map[string]*histogram, len(m.durations))
+	for pattern, h := range m.durations {
+		durations[pattern] = &histogram{buckets: append([]uint64(nil), h.buckets...), count: h.count, sum: h.sum}
+	}
+	return requests, durations
+}
+
+// write writes the metrics, with database gauges counting only what the audience
+// of the view can see, see stats.
+func (m *Metrics) write(w io.Writer, view *View) {
+	requests, durations := m.snapshot()
+
+	requestKeys := make([]requestKey, 0, len(requests))
+	for key := range requests {
+		requestKeys = append(requestKeys, key)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		if requestKeys[i].pattern != requestKeys[j].pattern {
+			return requestKeys[i].pattern < requestKeys[j].pattern
+		}
+		return requestKeys[i].code < requestKeys[j].code
+	})
+	header(w, "koi_http_requests_total", "counter", "Number of HTTP requests by route pattern and status code.")
+	for _, key := range requestKeys {
+		fmt.Fprintf(w, "koi_http_requests_total{pattern=%s,code=\"%d\"} %d\n", quote(key.pattern), key.code, requests[key])
+	}
+
+	patterns := make([]string, 0, len(durations))
+	for pattern := range durations {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	header(w, "koi_http_request_duration_seconds", "histogram", "Duration of HTTP requests by route pattern.")
+	for _, pattern := range patterns {
+		h := durations[pattern]
+		for i, bound := range _durationBuckets {
+			fmt.Fprintf(w, "koi_http_request_duration_seconds_bucket{pattern=%s,le=\"%s\"} %d\n", quote(pattern), formatFloat(bound), h.buckets[i])
+		}
+		fmt.Fprintf(w, "koi_http_request_duration_seconds_bucket{pattern=%s,le=\"+Inf\"} %d\n", quote(pattern), h.count)
+		fmt.Fprintf(w, "koi_http_request_duration_seconds_sum{pattern=%s} %s\n", quote(pattern), formatFloat(h.sum))
+		fmt.Fprintf(w, "koi_http_request_duration_seconds_count{pattern=%s} %d\n", quote(pattern), h.count)
+	}
+
+	header(w, "koi_template_render_errors_total", "counter", "Number of failed template executions.")
+	fmt.Fprintf(w, "koi_template_render_errors_total %d\n", m.renderErrors.Load())
+
+	header(w, "koi_database_reload_failures_total", "counter", "Number of failed attempts to reload the modified store file.")
+	fmt.Fprintf(w, "koi_database_reload_failures_total %d\n", m.reloadFailures.Load())
+
+	header(w, "koi_http_rate_limited_total", "counter", "Number of requests rejected because the client exceeded its rate.")
+	fmt.Fprintf(w, "koi_http_rate_limited_total %d\n", m.rateLimited.Load())
+
+	if view == nil {
+		return
+	}
+	stats := view.stats()
+	header(w, "koi_database_items", "gauge", "Number of items in the database listed for the caller.")
+	fmt.Fprintf(w, "koi_database_items %d\n", stats.Items)
+	header(w, "koi_database_tags", "gauge", "Number of tags in the database listed for the caller.")
+	fmt.Fprintf(w, "koi_database_tags %d\n", stats.Tags)
+	header(w, "koi_database_collections", "gauge", "Number of non-empty collections in the database listed for the caller.")
+	fmt.Fprintf(w, "koi_database_collections %d\n", stats.Collections)
+	header(w, "koi_database_decode_duration_seconds", "gauge", "Time it took to decode the store file.")
+	fmt.Fprintf(w, "koi_database_decode_duration_seconds %s\n", formatFloat(view.db.decodeDuration.Seconds()))
+	header(w, "koi_database_last_reload_timestamp_seconds", "gauge", "Unix time of the last successful database load.")
+	fmt.Fprintf(w, "koi_database_last_reload_timestamp_seconds %d\n", view.db.loaded.Unix())
+}
+
+func header(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Returns a quoted and escaped label value.
+func quote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Build version, can be set at link time with
+// -ldflags "-X src.acicovic.me/koipond/server.version=..."
+var version = "v1.6"
+
+// BuildInfo describes the running binary.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"buildTime,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+// DatabaseStats describes the database currently in use.
+type DatabaseStats struct {
+	Version      string    `json:"version"`
+	Items        int       `json:"items"`
+	Tags         int       `json:"tags"`
+	Collections  int       `json:"collections"`
+	Created      string    `json:"created"`
+	LastModified string    `json:"lastModified"`
+	Loaded       time.Time `json:"loaded"`
+}
+
+var _buildInfo = readBuildInfo()
+
+func readBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Commit = setting.Value
+			case "vcs.time":
+				info.BuildTime = setting.Value
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+// stats counts only the items, tags and collections listed for the audience
+// of the view, so that private ones are not revealed to anonymous callers.
+func (v *View) stats() DatabaseStats {
+	return DatabaseStats{
+		Version:      v.db.version,
+		Items:        len(v.listed(v.db.items)),
+		Tags:         len(v.tags()),
+		Collections:  len(v.collections()),
+		Created:      v.db.created.Format(time.DateOnly),
+		LastModified: v.db.lastModified.Format(time.DateOnly),
+		Loaded:       v.db.loaded,
+	}
+}
+
+// The process is alive if it can respond at all.
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// The server is ready when the database is decoded from the current store file,
+// templates are parsed, and it is not shutting down.
+func serveReadiness(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]bool{
+		"database":  currentDatabase() != nil,
+		"store":     !_storeStale.Load(),
+		"templates": _pageTemplate != nil,
+		"running":   !_serverControl.stopping.Load(),
+	}
+	status := http.StatusOK
+	for _, ok := range checks {
+		if !ok {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, checks)
+}
+
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	response := struct {
+		Build    BuildInfo      `json:"build"`
+		Database *DatabaseStats `json:"database,omitempty"`
+	}{
+		Build: _buildInfo,
+	}
+	if db := currentDatabase(); db != nil {
+		stats := db.view(audienceOf(r)).stats()
+		response.Database = &stats
+	}
+	writeJSON(w, http.StatusOK, response)
+}
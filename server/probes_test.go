@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withPrincipal returns the request as authenticated by the principal.
+func withPrincipal(r *http.Request, name string, scope string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, &Principal{Name: name, Scope: scope}))
+}
+
+func TestVersionCountsVisibleItems(t *testing.T) {
+	testStore(t)
+	for _, test := range []struct {
+		name  string
+		r     *http.Request
+		items int
+		tags  int
+	}{
+		{"anonymous", httptest.NewRequest(http.MethodGet, "/version", nil), 1, 1},
+		{"authenticated", withPrincipal(httptest.NewRequest(http.MethodGet, "/version", nil), "alice", SCOPE_ADMIN), 2, 1},
+	} {
+		w := httptest.NewRecorder()
+		serveVersion(w, test.r)
+		var response struct {
+			Database DatabaseStats `json:"database"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Database.Items != test.items || response.Database.Tags != test.tags {
+			t.Errorf("%s: %d items and %d tags, want %d and %d", test.name, response.Database.Items, response.Database.Tags, test.items, test.tags)
+		}
+
+		w = httptest.NewRecorder()
+		serveMetrics(w, test.r)
+		if want := fmt.Sprintf("koi_database_items %d\n", test.items); !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s: metrics do not include %q", test.name, want)
+		}
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	testStore(t)
+	if err := loadTemplates("../data", map[string]bool{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_storeStale.Store(false)
+		_serverControl.stopping.Store(false)
+	})
+	ready := func() (int, map[string]bool) {
+		w := httptest.NewRecorder()
+		serveReadiness(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		checks := map[string]bool{}
+		if err := json.Unmarshal(w.Body.Bytes(), &checks); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, checks
+	}
+
+	if status, checks := ready(); status != http.StatusOK {
+		t.Fatalf("status %d, want 200: %v", status, checks)
+	}
+	_storeStale.Store(true)
+	if status, checks := ready(); status != http.StatusServiceUnavailable || checks["store"] {
+		t.Errorf("with an outdated store: status %d, want 503 with the store check failed: %v", status, checks)
+	}
+	_storeStale.Store(false)
+	_serverControl.stopping.Store(true)
+	if status, checks := ready(); status != http.StatusServiceUnavailable || checks["running"] {
+		t.Errorf("while shutting down: status %d, want 503 with the running check failed: %v", status, checks)
+	}
+}
@@ -1,41 +1,76 @@
 package server
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"html/template"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
+// Template files, relative to the data directory.
+var _templateFiles = []string{
+	"main.html",
+	"style-pretty.html",
+	"books.html",
+	"games.html",
+	"boardgames.html",
+}
+
+// Set up by loadTemplates.
 var (
-	_pageTemplate = template.Must(
-		template.
-			New("page").
-			ParseFiles(
-				"data/main.html",
-				"data/style-pretty.html",
-				"data/books.html",
-				"data/games.html",
-				"data/boardgames.html",
-			),
-	)
-
-	_customizer = &RenderingCustomizer{
-		map[string]bool{
-			"@enable-kanji":            false,
-			"@enable-list-decorations": true,
-		},
-	}
-
-	_fileServer = http.FileServer(http.Dir("data/static"))
+	_pageTemplate     *template.Template
+	_templatesVersion string
+	_templatesModTime time.Time
+	_customizer       *RenderingCustomizer
+	_styleHashes      []string
+	_fileServer       http.Handler
+	_staticDir        string
 )
 
+// loadTemplates parses templates found in the data directory, and sets up
+// the file server for static files in the static/ subdirectory.
+func loadTemplates(dataDir string, flags map[string]bool) (err error) {
+	files := make([]string, len(_templateFiles))
+	for i, file := range _templateFiles {
+		files[i] = filepath.Join(dataDir, file)
+	}
+
+	if _pageTemplate, err = template.New("page").ParseFiles(files...); err != nil {
+		return fmt.Errorf("failed to parse templates: %v", err)
+	}
+	if _templatesVersion, _templatesModTime, err = templatesVersion(files, flags); err != nil {
+		return err
+	}
+	_customizer = &RenderingCustomizer{flags}
+	if _styleHashes, err = inlineStyleHashes(_pageTemplate, "style-pretty.html", _customizer); err != nil {
+		return err
+	}
+	_staticDir = filepath.Join(dataDir, "static")
+	_fileServer = http.FileServer(http.Dir(_staticDir))
+
+	return nil
+}
+
 // HTMLPage is a main wrapper object sent to the template engine when rendering HTML.
 // It contains standard elements of an HTML, e.g. Title, as well as a data object
-// that needs to be rendered.
+// that needs to be rendered. Links to administration pages are shown if Admin is
+// set, see requireAdmin.
 type HTMLPage struct {
 	Key          string
 	Title        string
 	Supertitle   string
 	ErrorMessage string
+	CSRFToken    string
+	Next         string
+	Admin        bool
 	Data         DataObjectInterface
 }
 
@@ -43,9 +78,123 @@ func (p *HTMLPage) Customizer() *RenderingCustomizer {
 	return _customizer
 }
 
-func render(w http.ResponseWriter, p HTMLPage) {
-	err := _pageTemplate.ExecuteTemplate(w, "main.html", &p)
+// IsItem reports whether the page shows a single item.
+func (p *HTMLPage) IsItem() bool {
+	return strings.HasSuffix(p.Key, "/item")
+}
+
+func render(w http.ResponseWriter, status int, p HTMLPage) {
+	if page, ok := execute(p); ok {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write(page)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// renderCached renders the page only if it was not already rendered
+// for the request path using the same Database instance and audience.
+// Administrators get their own copy of the page, with links to
+// administration pages.
+//
+// Responses carry a weak ETag and a Last-Modified header, derived from
+// the Database and template versions, and conditional requests
+// (If-None-Match, If-Modified-Since) are answered with 304 Not Modified.
+func renderCached(w http.ResponseWriter, r *http.Request, view *View, p HTMLPage) {
+	p.Admin = isAdmin(r)
+	key := r.URL.Path
+	if p.Admin {
+		// paths start with a slash, so this cannot be the key of another page
+		key = "admin:" + key
+	}
+	page, found := view.cachedPage(key)
+	if !found {
+		var ok bool
+		if page, ok = execute(p); !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		view.cachePage(key, page)
+	}
+	serveVersioned(w, r, view, "text/html; charset=utf-8", page)
+}
+
+// serveVersioned writes content that depends only on the Database, the audience,
+// whether the request is made by an administrator, and the templates, with
+// caching headers set.
+func serveVersioned(w http.ResponseWriter, r *http.Request, view *View, contentType string, content []byte) {
+	modified := view.db.modified()
+	if _templatesModTime.After(modified) {
+		modified = _templatesModTime
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _auth != nil {
+		// content depends on whether the user is authenticated
+		w.Header().Add("Vary", "Cookie, Authorization")
+	}
+	if view.audience == AUDIENCE_PUBLIC {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+	if w.Header().Get("ETag") == "" {
+		// unless the handler has a more specific one, e.g. the revision of an item
+		admin := ""
+		if isAdmin(r) {
+			admin = "-admin"
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`W/"%s-%s-%d%s"`, view.db.version, _templatesVersion, view.audience, admin))
+	}
+	http.ServeContent(w, r, "", modified, bytes.NewReader(content))
+}
+
+// writeJSON writes v encoded as JSON, with the status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	content, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
-		trace(_error, "http: render template: %v", err)
+		traceError(_https, "encode JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(append(content, '\n'))
+}
+
+func execute(p HTMLPage) (page []byte, ok bool) {
+	buf := &bytes.Buffer{}
+	if err := _pageTemplate.ExecuteTemplate(buf, "main.html", &p); err != nil {
+		traceError(_https, "render template: %v", err)
+		_metrics.renderErrors.Add(1)
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// Returns a short hash of the content of all template files and rendering flags,
+// and the time of the latest modification of any of the files.
+func templatesVersion(files []string, flags map[string]bool) (version string, modified time.Time, err error) {
+	hash := sha256.New()
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("failed to read template file %s: %v", file, err)
+		}
+		hash.Write(content)
+		if fi, err := os.Stat(file); err == nil && fi.ModTime().After(modified) {
+			modified = fi.ModTime().UTC()
+		}
+	}
+	keys := make([]string, 0, len(flags))
+	for key := range flags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s=%t;", key, flags[key])
 	}
+	version = hex.EncodeToString(hash.Sum(nil))[:16]
+	return
 }
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// BENCH_ITEMS is the number of items in the synthetic benchmark database.
+const BENCH_ITEMS = 10000
+
+// benchDatabase decodes a generated store file with BENCH_ITEMS items of three
+// types, spread over 20 collections and 100 tags, and loads the templates.
+func benchDatabase(b *testing.B) *Database {
+	b.Helper()
+	_logger = newLogger(&strings.Builder{}, LOG_FORMAT_TEXT, slog.LevelError)
+	if err := loadTemplates("../data", map[string]bool{}); err != nil {
+		b.Fatal(err)
+	}
+
+	var xml strings.Builder
+	xml.WriteString(`<koidatabase created="2024-01-01" lastModified="2024-01-01">`)
+	xml.WriteString(`<koitypes enabled="books,games,equipment"><metadata key="books/lang" default="English"/></koitypes>`)
+	xml.WriteString(`<collections>`)
+	for c := 0; c < 20; c++ {
+		fmt.Fprintf(&xml, `<collection key="collection%s" name="Collection %d"/>`, benchWord(c), c)
+	}
+	xml.WriteString(`</collections><data>`)
+	types := []struct{ typeKey, alias, label string }{
+		{"books", "book", "title"},
+		{"games", "game", "title"},
+		{"equipment", "item", "label"},
+	}
+	for _, t := range types {
+		fmt.Fprintf(&xml, "<%s>", t.typeKey)
+		for i := 0; i < BENCH_ITEMS/len(types); i++ {
+			fmt.Fprintf(&xml, `<%s %s="%s %d" author="Author %d" collections="collection%s" tags="tag%s,tag%s"/>`,
+				t.alias, t.label, t.typeKey, i, i%500, benchWord(i%20), benchWord(i%100), benchWord((i+7)%100))
+		}
+		fmt.Fprintf(&xml, "</%s>", t.typeKey)
+	}
+	xml.WriteString(`</data></koidatabase>`)
+
+	db, err := DecodeDatabase(strings.NewReader(xml.String()))
+	if err != nil {
+		b.Fatal(err)
+	}
+	db.version = "bench"
+	_database.Store(db)
+	return db
+}
+
+// benchWord spells the number in letters, since keys of collections and tags
+// must be words, e.g. "bq" for 42.
+func benchWord(n int) string {
+	return string(rune('a'+n/26)) + string(rune('a'+n%26))
+}
+
+// benchExecute renders the page without the page cache, with a catalogue made
+// for every request, as pages were rendered before catalogues were precomputed.
+func benchExecute(b *testing.B, p HTMLPage) {
+	b.Helper()
+	if _, ok := execute(p); !ok {
+		b.Fatal("render failed")
+	}
+}
+
+// benchServe serves the path through the handler, with precomputed catalogues
+// and the page cache of the view.
+func benchServe(b *testing.B, handler http.HandlerFunc, pattern string, path string) {
+	b.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc(pattern, handler)
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			b.Fatalf("%s: status %d", path, w.Code)
+		}
+	}
+}
+
+func BenchmarkRenderCatalogue(b *testing.B) {
+	db := benchDatabase(b)
+	b.Run("before-precompute", func(b *testing.B) {
+		view := db.view(AUDIENCE_PUBLIC)
+		for i := 0; i < b.N; i++ {
+			catalogue := makeCatalogue(view.listed(db.items))
+			benchExecute(b, HTMLPage{Key: "@catalogue", Supertitle: "All", Title: "Items", Data: catalogue})
+		}
+	})
+	b.Run("after-precompute", func(b *testing.B) {
+		benchServe(b, renderItems, "GET /items", "/items")
+	})
+}
+
+func BenchmarkRenderTag(b *testing.B) {
+	db := benchDatabase(b)
+	b.Run("before-precompute", func(b *testing.B) {
+		view := db.view(AUDIENCE_PUBLIC)
+		for i := 0; i < b.N; i++ {
+			catalogue := makeCatalogue(view.listed(db.tagged["tagcq"]))
+			benchExecute(b, HTMLPage{Key: "@catalogue", Supertitle: "Items tagged with", Title: "tagcq", Data: catalogue})
+		}
+	})
+	b.Run("after-precompute", func(b *testing.B) {
+		benchServe(b, renderTag, "GET /tags/{tag}", "/tags/tagcq")
+	})
+}
+
+func BenchmarkRenderItem(b *testing.B) {
+	db := benchDatabase(b)
+	b.Run("before-precompute", func(b *testing.B) {
+		view := db.view(AUDIENCE_PUBLIC)
+		for i := 0; i < b.N; i++ {
+			item := view.singleItem(4242)
+			benchExecute(b, HTMLPage{Key: "@" + item.Type + "/item", Supertitle: TypeLabel(item.Type), Title: item.Label, Data: item})
+		}
+	})
+	b.Run("after-precompute", func(b *testing.B) {
+		benchServe(b, renderItem, "GET /items/{id}", "/items/4242")
+	})
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// itemRevision returns the revision of an item with the attributes, the first 16
+// hex characters of their SHA-256 hash, like the version of the store file. It
+// changes whenever the item element is changed, but not when defaults change, and
+// since it does not depend on the position of the item, it is the same in every
+// version of the store file that has the same attributes.
+func itemRevision(attrs map[string]string) string {
+	keys := mapKeys(attrs)
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, key := range keys {
+		hash.Write([]byte(key))
+		hash.Write([]byte{0})
+		hash.Write([]byte(attrs[key]))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// etag returns the revision as a strong entity tag.
+func etag(revision string) string {
+	return `"` + revision + `"`
+}
+
+// matchesETag reports whether the If-Match header matches the revision.
+// Weak entity tags never match, see RFC 9110, section 13.1.1.
+func matchesETag(ifMatch string, revision string) bool {
+	for _, tag := range strings.Split(ifMatch, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag(revision) {
+			return true
+		}
+	}
+	return false
+}
+
+// changesSince returns the changes of the item's attributes since the revision,
+// or nil if they are not known, e.g. the item was changed by hand, since both
+// the revision and the current one are looked up in the item's history.
+func changesSince(db *Database, item *Item, revision string) []*ValueChange {
+	uid := item.Metadata[MKEY_UID]
+	if uid == "" {
+		return nil
+	}
+	entries, err := itemHistory(db.filePath, uid)
+	if err != nil {
+		traceError(_https, "history: %v", err)
+		return nil
+	}
+	var before, current map[string]string
+	for _, entry := range entries {
+		for _, attrs := range []map[string]string{entry.Before, entry.After} {
+			if attrs == nil {
+				continue
+			}
+			switch itemRevision(attrs) {
+			case revision:
+				before = attrs
+			case item.Revision:
+				current = attrs
+			}
+		}
+	}
+	if before == nil || current == nil {
+		return nil
+	}
+	return diffMaps(before, current)
+}
+
+// ItemConflict is the response to a change of an item based on an outdated revision.
+type ItemConflict struct {
+	Error    string      `json:"error"`
+	Revision string      `json:"revision"`
+	Item     *ItemObject `json:"item"`
+	// changes since the outdated revision, if they are known, see changesSince
+	Changes []*ValueChange `json:"changes,omitempty"`
+}
+
+// checkFormRevision reports whether the revision submitted with a form is the
+// revision of the item. If it is not, the item was changed since the page with
+// the form was rendered, which is reported with its changes, and false is returned.
+func checkFormRevision(w http.ResponseWriter, r *http.Request, db *Database, item *Item) bool {
+	revision := r.PostFormValue("revision")
+	if revision == item.Revision {
+		return true
+	}
+	message := &strings.Builder{}
+	message.WriteString("The item was changed in the meantime, reload the page and try again.\n")
+	if changes := changesSince(db, item, revision); len(changes) > 0 {
+		message.WriteString("\nChanges:\n")
+		writeValueChanges(message, "  ", changes)
+	}
+	http.Error(w, message.String(), http.StatusConflict)
+	return false
+}
@@ -1,70 +1,195 @@
 package server
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"strconv"
+	"sync/atomic"
+	"time"
 )
 
-// Run configures the system, builds the database, and boots the server.
-func Run() {
-	trace(_control, "main: start: %s v1.6", filepath.Base(os.Args[0]))
-	readEnvironment()
-	buildDatabase()
-	_serverControl.boot()
+// Exit codes returned by Run.
+const (
+	EXIT_OK      = 0
+	EXIT_FAILURE = 1
+	EXIT_CONFIG  = 2
+)
+
+// Run runs a command if one is named in the arguments. Otherwise, it
+// configures the system, builds the database, and boots the server.
+// It returns when the server is shut down, with the process exit code.
+func Run() int {
+	if exitCode, found := runCommand(os.Args[1:]); found {
+		return exitCode
+	}
+	if exit, err := configure(os.Args[1:]); exit {
+		return EXIT_OK
+	} else if err != nil {
+		traceError(_control, "main: %v", err)
+		return EXIT_CONFIG
+	}
+	trace(_control, "main: start: %s %s", filepath.Base(os.Args[0]), _buildInfo.Version)
+	if err := buildDatabase(); err != nil {
+		traceError(_control, "main: %v", err)
+		return EXIT_FAILURE
+	}
+	go watchDatabase()
+	if _config.Trash.Retention > 0 {
+		stop := make(chan struct{})
+		go purgeTrash(stop)
+		_serverControl.onShutdown(func() error {
+			close(stop)
+			return nil
+		})
+	}
+	// registered last, so that it runs after everything that changes the store file is stopped
+	_serverControl.onShutdown(drainStoreChanges)
+	if err := _serverControl.boot(); err != nil {
+		traceError(_control, "main: %v", err)
+		return EXIT_FAILURE
+	}
+	return EXIT_OK
 }
 
-func readEnvironment() {
-	const (
-		ENVV_MODE = "KOIPOND_MODE"
-		ENVV_PORT = "KOIPOND_PORT"
-	)
-
-	mode := os.Getenv(ENVV_MODE)
-	trace(_env, "%s = %q", ENVV_MODE, mode)
-	if mode == "" {
-		mode = "prod"
-	}
-
-	if mode == "dev" {
-		_serverControl.endpoint = "localhost:8072"
-	} else if mode == "prod" || mode == "prod-local-listener" {
-		port := os.Getenv(ENVV_PORT)
-		trace(_env, "%s = %q", ENVV_PORT, port)
-		if num, err := strconv.Atoi(port); err != nil || num < 1 || num > 65535 {
-			panic(fmt.Errorf("value of %s is invalid or is not a valid TCP port number", ENVV_PORT))
-		}
-		if mode == "prod-local-listener" {
-			_serverControl.endpoint = "127.0.0.1:" + port
-		} else {
-			_serverControl.endpoint = "0.0.0.0:" + port
+// configure reads the configuration and sets up everything that depends on it.
+// If exit is true, the user only asked for help or for the configuration to
+// be printed, and there is nothing else to do.
+func configure(args []string) (exit bool, err error) {
+	config, printOnly, err := readConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("invalid configuration: %v", err)
+	}
+	if printOnly {
+		config.print()
+		return true, nil
+	}
+	_config = config
+
+	// logging is configured first, so that everything else is traced in the right format
+	if err = configureLogging(_config.Log.Format, _config.Log.Level); err != nil {
+		return false, err
+	}
+	trace(_env, "store = %s", _config.Store)
+	trace(_env, "data = %s", _config.Data)
+
+	if err = loadTemplates(_config.Data, _config.Rendering); err != nil {
+		return false, err
+	}
+
+	_securityHeaders = newSecurityHeaders(_config.Headers, _styleHashes, _config.TLS.Cert != "")
+
+	if _config.Auth.enabled() {
+		if _auth, err = newAuthenticator(_config.Auth, _config.TLS.Cert != ""); err != nil {
+			return false, err
 		}
-	} else {
-		panic(fmt.Errorf("value of %s is invalid", ENVV_MODE))
+		trace(_control, "main: authentication enabled for %d users", len(_auth.users))
+	}
+
+	if _trustedProxies, err = parseNetworks(_config.TrustedProxies); err != nil {
+		return false, err
+	}
+	_maxBodyBytes = _config.Limits.MaxBodyBytes
+	if _config.Limits.Rate > 0 {
+		_rateLimiter = newRateLimiter(_config.Limits.Rate, _config.Limits.Burst)
+		trace(_control, "main: rate limiting enabled, %v requests per second with bursts of %d", _config.Limits.Rate, _config.Limits.Burst)
 	}
-	trace(_control, "main: in mode %q (HTTP): endpoint will be http://%s", mode, _serverControl.endpoint)
 
-	// always read koidata.xml from store/ relative to the working directory
-	// @hardcoded
-	if abs, err := filepath.Abs("store/koidata.xml"); err != nil {
-		panic(fmt.Errorf("failed to compose full store path: %v", err))
+	_serverControl.endpoint = _config.Listen
+	_serverControl.limits = _config.Limits
+	_serverControl.certFile = _config.TLS.Cert
+	_serverControl.keyFile = _config.TLS.Key
+	_serverControl.redirectEndpoint = _config.TLS.RedirectListen
+	_serverControl.shutdownTimeout = time.Duration(_config.ShutdownTimeout)
+	if _serverControl.tlsEnabled() {
+		trace(_control, "main: endpoint will be https://%s", _serverControl.endpoint)
 	} else {
-		_database.filePath = abs
+		trace(_control, "main: endpoint will be http://%s", _serverControl.endpoint)
 	}
+
+	return false, nil
 }
 
 func buildDatabase() error {
-	trace(_decoder, "decoding %s", _database.filePath)
-	file, err := os.Open(_database.filePath)
+	db, err := loadDatabase(_config.Store)
 	if err != nil {
-		panic(fmt.Errorf("failed to open file %s: %v", _database.filePath, err))
+		return err
+	}
+	_database.Store(db)
+	return nil
+}
+
+func loadDatabase(path string) (*Database, error) {
+	trace(_decoder, "decoding %s", path)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %v", path, err)
 	}
 	defer file.Close()
 
-	if err = DecodeDatabase(file); err != nil {
-		panic(fmt.Errorf("failed to decode database in %s: %v", _database.filePath, err))
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file %s: %v", path, err)
 	}
 
-	return nil
+	hash := sha256.New()
+	tee := io.TeeReader(file, hash)
+	start := time.Now()
+	db, err := DecodeDatabase(tee)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode database in %s: %v", path, err)
+	}
+	// whatever is left after </koidatabase> is still part of the version
+	io.Copy(io.Discard, tee)
+	db.filePath = path
+	db.fileModTime = fi.ModTime().UTC()
+	db.version = hex.EncodeToString(hash.Sum(nil))[:16]
+	db.decodeDuration = time.Since(start)
+	db.loaded = time.Now().UTC()
+
+	return db, nil
+}
+
+// Set when the store file was modified but could not be decoded, so that the
+// database in use is outdated, and cleared when it is decoded again.
+var _storeStale atomic.Bool
+
+// watchDatabase periodically checks if the store file was modified, and if so,
+// replaces the global database with a freshly decoded one. If the new file cannot
+// be decoded, the old database is kept in use.
+func watchDatabase() {
+	modTime := func() time.Time {
+		fi, err := os.Stat(_config.Store)
+		if err != nil {
+			return time.Time{}
+		}
+		return fi.ModTime()
+	}
+
+	lastModTime := modTime()
+	for range time.Tick(time.Duration(_config.StorePollInterval)) {
+		current := modTime()
+		if current.IsZero() || current.Equal(lastModTime) {
+			continue
+		}
+		lastModTime = current
+		trace(_decoder, "store file modified, reloading database")
+		db, err := loadDatabase(_config.Store)
+		if err != nil {
+			traceError(_decoder, "reload: %v", err)
+			_metrics.reloadFailures.Add(1)
+			_storeStale.Store(true)
+			continue
+		}
+		_database.Store(db)
+		_storeStale.Store(false)
+		trace(_decoder, "database reloaded, %d items", len(db.items))
+	}
 }
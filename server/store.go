@@ -0,0 +1,374 @@
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"src.acicovic.me/koipond/set"
+)
+
+// The store file is written by hand, so it is never encoded from a Database:
+// that would lose comments and formatting, and bake defaults into items.
+// Instead, new content is inserted at offsets found by scanning the file.
+
+// storeLayout holds offsets of elements in the store file.
+type storeLayout struct {
+	rootEnd   int // end of the <koidatabase> start tag
+	dataStart int // start of <data>
+	dataEnd   int // start of </data>
+	// the last <TYPE> section in <data>, for every type, and the last <trash>
+	sections map[string]*storeSection
+	// the last <TYPE> section in <trash>, for every type
+	trashSections map[string]*storeSection
+}
+
+type storeSection struct {
+	start       int // start of <TYPE>
+	end         int // start of </TYPE>, or the end of <TYPE/>
+	selfClosing bool
+	firstItem   int // start of the first item, -1 if there are none
+}
+
+var lastModifiedAttrRE = regexp.MustCompile(`(\s` + XMLATTR_LASTMODIFIED + `\s*=\s*)("[^"]*"|'[^']*')`)
+
+func scanStore(content []byte) (*storeLayout, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	layout := &storeLayout{sections: map[string]*storeSection{}, trashSections: map[string]*storeSection{}, dataEnd: -1}
+	path := []string{}
+	// sections of elements in the path, nil for other elements
+	sections := []*storeSection{}
+	startEnd := 0
+	for {
+		offset := int(decoder.InputOffset())
+		tok, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan store file: %v", err)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if len(sections) > 0 {
+				if parent := sections[len(sections)-1]; parent != nil && parent.firstItem < 0 {
+					parent.firstItem = offset
+				}
+			}
+			path = append(path, tok.Name.Local)
+			startEnd = int(decoder.InputOffset())
+			section := (*storeSection)(nil)
+			switch {
+			case len(path) == 1:
+				layout.rootEnd = startEnd
+			case len(path) == 2 && path[1] == XMLNODE_DATA:
+				layout.dataStart = offset
+			case len(path) == 3 && path[1] == XMLNODE_DATA:
+				section = &storeSection{start: offset, firstItem: -1}
+				layout.sections[tok.Name.Local] = section
+			case len(path) == 4 && path[1] == XMLNODE_DATA && path[2] == XMLNODE_TRASH:
+				section = &storeSection{start: offset, firstItem: -1}
+				layout.trashSections[tok.Name.Local] = section
+			}
+			sections = append(sections, section)
+		case xml.EndElement:
+			if len(path) == 2 && path[1] == XMLNODE_DATA {
+				layout.dataEnd = offset
+			}
+			if section := sections[len(sections)-1]; section != nil {
+				section.end = offset
+				section.selfClosing = offset == startEnd && bytes.HasSuffix(content[:offset], []byte("/>"))
+			}
+			path = path[:len(path)-1]
+			sections = sections[:len(sections)-1]
+		}
+	}
+	if len(path) > 0 || layout.rootEnd == 0 || layout.dataEnd < 0 {
+		return nil, fmt.Errorf("failed to scan store file: %w", ErrInvalidFormat)
+	}
+	return layout, nil
+}
+
+// indentUnit returns the indentation of <data>, which is one level deep.
+func (l *storeLayout) indentUnit(content []byte) string {
+	if unit := lineIndent(content, l.dataStart); unit != "" {
+		return unit
+	}
+	return "    "
+}
+
+// appendToStore returns the content of the store file with the items (metadata
+// as ordered attributes) appended to the section of the type, which is created
+// if it does not exist, and with the lastModified date set.
+func appendToStore(content []byte, typeKey string, items [][]xml.Attr, modified time.Time) ([]byte, error) {
+	layout, err := scanStore(content)
+	if err != nil {
+		return nil, err
+	}
+	elements := make([]string, len(items))
+	for i, attrs := range items {
+		var text strings.Builder
+		writeItemElement(&text, ItemAlias(typeKey), attrs)
+		elements[i] = text.String()
+	}
+	content = appendToSection(content, layout.dataStart, layout.dataEnd, layout.sections[typeKey], typeKey, elements, layout.indentUnit(content))
+	return touchStore(content, layout.rootEnd, modified), nil
+}
+
+// appendToTrash returns the content of the store file with the item element
+// appended to the section of its type in <trash>, which is created if it does
+// not exist, and with the lastModified date set.
+func appendToTrash(content []byte, item *storeItem, attrs []xml.Attr, modified time.Time) ([]byte, error) {
+	layout, err := scanStore(content)
+	if err != nil {
+		return nil, err
+	}
+	unit := layout.indentUnit(content)
+	if trash := layout.sections[XMLNODE_TRASH]; trash == nil || trash.selfClosing {
+		content = appendToSection(content, layout.dataStart, layout.dataEnd, trash, XMLNODE_TRASH, nil, unit)
+		if layout, err = scanStore(content); err != nil {
+			return nil, err
+		}
+	}
+	var text strings.Builder
+	writeItemElement(&text, item.alias, attrs)
+	trash := layout.sections[XMLNODE_TRASH]
+	content = appendToSection(content, trash.start, trash.end, layout.trashSections[item.typeKey], item.typeKey, []string{text.String()}, unit)
+	return touchStore(content, layout.rootEnd, modified), nil
+}
+
+// appendToSection returns the content with the elements, one per line, appended
+// to the section in the parent element, which starts at parentStart, and whose
+// end tag starts at parentEnd. If the section is nil, a section with the name
+// is created at the end of the parent. Elements are indented like the first
+// element already in the section, or by one unit more than the section.
+func appendToSection(content []byte, parentStart int, parentEnd int, section *storeSection, name string, elements []string, unit string) []byte {
+	parentIndent := lineIndent(content, parentStart)
+
+	var (
+		at, end       int
+		text          strings.Builder
+		sectionIndent string
+		elementIndent string
+		writeElements = func() {
+			for _, element := range elements {
+				text.WriteString(elementIndent)
+				text.WriteString(element)
+				text.WriteString("\n")
+			}
+		}
+	)
+
+	if section != nil {
+		sectionIndent = lineIndent(content, section.start)
+		elementIndent = sectionIndent + unit
+		if section.firstItem >= 0 && onOwnLine(content, section.firstItem) {
+			elementIndent = lineIndent(content, section.firstItem)
+		}
+		switch {
+		case section.selfClosing:
+			// <TYPE/> is replaced with <TYPE>...</TYPE>
+			at, end = section.start, section.end
+			fmt.Fprintf(&text, "<%s>\n", name)
+			writeElements()
+			fmt.Fprintf(&text, "%s</%s>", sectionIndent, name)
+		case onOwnLine(content, section.end):
+			at = lineStart(content, section.end)
+			writeElements()
+		default:
+			at = section.end
+			text.WriteString("\n")
+			writeElements()
+			text.WriteString(sectionIndent)
+		}
+	} else {
+		sectionIndent = parentIndent + unit
+		elementIndent = sectionIndent + unit
+		writeSection := func() {
+			fmt.Fprintf(&text, "%s<%s>\n", sectionIndent, name)
+			writeElements()
+			fmt.Fprintf(&text, "%s</%s>\n", sectionIndent, name)
+		}
+		if onOwnLine(content, parentEnd) {
+			at = lineStart(content, parentEnd)
+			writeSection()
+		} else {
+			at = parentEnd
+			text.WriteString("\n")
+			writeSection()
+			text.WriteString(parentIndent)
+		}
+	}
+	if end < at {
+		end = at
+	}
+
+	result := make([]byte, 0, len(content)+text.Len())
+	result = append(result, content[:at]...)
+	result = append(result, text.String()...)
+	return append(result, content[end:]...)
+}
+
+// touchStore sets the lastModified date in the <koidatabase> start tag, which ends at rootEnd.
+func touchStore(content []byte, rootEnd int, modified time.Time) []byte {
+	root := lastModifiedAttrRE.ReplaceAll(content[:rootEnd], []byte(`${1}"`+modified.Format(time.DateOnly)+`"`))
+	return append(root, content[rootEnd:]...)
+}
+
+// storeItem is an item element in the store file.
+type storeItem struct {
+	start   int // start of the element
+	end     int // end of the element, including its end tag
+	typeKey string
+	alias   string
+	attrs   []xml.Attr
+}
+
+// metadata returns the attributes of the element, as they are written in the store file.
+func (si *storeItem) metadata() map[string]string {
+	metadata := make(map[string]string, len(si.attrs))
+	for _, attr := range si.attrs {
+		metadata[attr.Name.Local] = attr.Value
+	}
+	return metadata
+}
+
+// scanItems returns the item elements of the store file that are decoded into
+// items of a Database with the enabled types, in the same order, so that the
+// index of an element is the ID of its item, and likewise the elements of items
+// in the trash. Elements that the decoder skips, e.g. items of disabled types
+// or items without a label, are left out.
+func scanItems(content []byte, enabledTypes set.Strings) (items []*storeItem, trashed []*storeItem, err error) {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	items, trashed = []*storeItem{}, []*storeItem{}
+	path := []string{}
+	current := (*storeItem)(nil)
+	for {
+		offset := int(decoder.InputOffset())
+		tok, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to scan store file: %v", err)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			path = append(path, tok.Name.Local)
+			if len(path) < 4 || path[1] != XMLNODE_DATA || current != nil {
+				continue
+			}
+			inTrash := path[2] == XMLNODE_TRASH
+			if len(path) != 4 && !(inTrash && len(path) == 5) || len(path) == 4 && inTrash {
+				continue
+			}
+			typeKey := path[len(path)-2]
+			if !isValidWord(typeKey) || !enabledTypes.Contains(typeKey) || !IsValidItemAliasForType(tok.Name.Local, typeKey) {
+				continue
+			}
+			current = &storeItem{start: offset, typeKey: typeKey, alias: tok.Name.Local, attrs: tok.Copy().Attr}
+			if current.metadata()[ItemLabelKey(typeKey)] == "" {
+				current = nil
+			}
+		case xml.EndElement:
+			if current != nil && tok.Name.Local == current.alias && (len(path) == 4 || len(path) == 5 && path[2] == XMLNODE_TRASH) {
+				current.end = int(decoder.InputOffset())
+				if len(path) == 5 {
+					trashed = append(trashed, current)
+				} else {
+					items = append(items, current)
+				}
+				current = nil
+			}
+			path = path[:len(path)-1]
+		}
+	}
+	return items, trashed, nil
+}
+
+// removeFromStore returns the content of the store file without the item
+// elements, and their lines if they were alone on them, and with the
+// lastModified date set.
+func removeFromStore(content []byte, items []*storeItem, modified time.Time) ([]byte, error) {
+	layout, err := scanStore(content)
+	if err != nil {
+		return nil, err
+	}
+	items = append([]*storeItem(nil), items...)
+	sort.Slice(items, func(i, j int) bool { return items[i].start < items[j].start })
+
+	result := make([]byte, 0, len(content))
+	last := 0
+	for _, item := range items {
+		start, end := item.start, item.end
+		if onOwnLine(content, start) {
+			if i := bytes.IndexByte(content[end:], '\n'); i >= 0 && len(bytes.TrimSpace(content[end:end+i])) == 0 {
+				start, end = lineStart(content, start), end+i+1
+			}
+		}
+		result = append(result, content[last:start]...)
+		last = end
+	}
+	result = append(result, content[last:]...)
+	return touchStore(result, layout.rootEnd, modified), nil
+}
+
+// replaceInStore returns the content of the store file with the item element
+// replaced by an element with the attributes, and with the lastModified date set.
+func replaceInStore(content []byte, item *storeItem, attrs []xml.Attr, modified time.Time) ([]byte, error) {
+	layout, err := scanStore(content)
+	if err != nil {
+		return nil, err
+	}
+	var text strings.Builder
+	writeItemElement(&text, item.alias, attrs)
+
+	result := make([]byte, 0, len(content)+text.Len())
+	result = append(result, content[:item.start]...)
+	result = append(result, text.String()...)
+	result = append(result, content[item.end:]...)
+	return touchStore(result, layout.rootEnd, modified), nil
+}
+
+// Escapes only what must be escaped in double-quoted attribute values,
+// so that written values stay readable, e.g. apostrophes in titles.
+var _attrEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	`"`, "&quot;",
+	"\n", "&#xA;",
+	"\r", "&#xD;",
+	"\t", "&#x9;",
+)
+
+// writeItemElement writes an empty element with the attributes, e.g. <book title="..."/>.
+func writeItemElement(w *strings.Builder, name string, attrs []xml.Attr) {
+	fmt.Fprintf(w, "<%s", name)
+	for _, attr := range attrs {
+		fmt.Fprintf(w, " %s=\"%s\"", attr.Name.Local, _attrEscaper.Replace(attr.Value))
+	}
+	w.WriteString("/>")
+}
+
+// lineStart returns the offset of the start of the line containing the offset.
+func lineStart(content []byte, offset int) int {
+	return bytes.LastIndexByte(content[:offset], '\n') + 1
+}
+
+// onOwnLine reports whether there is only whitespace before the offset on its line.
+func onOwnLine(content []byte, offset int) bool {
+	return len(bytes.TrimLeft(content[lineStart(content, offset):offset], " \t")) == 0
+}
+
+// lineIndent returns the whitespace at the start of the line containing the offset.
+func lineIndent(content []byte, offset int) string {
+	line := content[lineStart(content, offset):offset]
+	return string(line[:len(line)-len(bytes.TrimLeft(line, " \t"))])
+}
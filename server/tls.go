@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How often certificate and key files are checked for modifications.
+const certPollInterval = 10 * time.Second
+
+// certReloader keeps the TLS certificate loaded from files, and loads it
+// again when the files change or when SIGHUP is received. Connections
+// that are already established are not affected by the reload.
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func newCertReloader(certPath string, keyPath string) (*certReloader, error) {
+	c := &certReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cert = &cert
+	c.modTimes = c.currentModTimes()
+	return nil
+}
+
+func (c *certReloader) currentModTimes() (modTimes [2]time.Time) {
+	for i, path := range []string{c.certPath, c.keyPath} {
+		if fi, err := os.Stat(path); err == nil {
+			modTimes[i] = fi.ModTime()
+		}
+	}
+	return
+}
+
+func (c *certReloader) modified() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.currentModTimes() != c.modTimes
+}
+
+// GetCertificate is used as tls.Config.GetCertificate.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, nil
+}
+
+// watch reloads the certificate when files are modified or on SIGHUP.
+// If the new certificate cannot be loaded, the old one is kept in use.
+func (c *certReloader) watch() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	ticker := time.NewTicker(certPollInterval)
+	for {
+		select {
+		case <-hangups:
+			trace(_https, "SIGHUP received, reloading TLS certificate")
+		case <-ticker.C:
+			if !c.modified() {
+				continue
+			}
+			trace(_https, "TLS certificate or key file modified, reloading TLS certificate")
+		}
+		if err := c.reload(); err != nil {
+			traceError(_https, "%v", err)
+			continue
+		}
+		trace(_https, "TLS certificate reloaded")
+	}
+}
+
+func newTLSConfig(certs *certReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		GetCertificate:   certs.GetCertificate,
+	}
+}
+
+// redirectToHTTPS returns a handler that redirects every request to
+// the same URL on the HTTPS endpoint.
+func redirectToHTTPS(httpsEndpoint string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsEndpoint)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
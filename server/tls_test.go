@@ -0,0 +1,154 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a self-signed certificate for localhost with the
+// common name, and its key, to the files.
+func writeSelfSignedCert(t *testing.T, certPath string, keyPath string, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handshake connects to the address and returns the common name of the
+// certificate presented by the server.
+func handshake(t *testing.T, addr string) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertReload(t *testing.T) {
+	_logger = newLogger(io.Discard, LOG_FORMAT_TEXT, slog.LevelError)
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	writeSelfSignedCert(t, certPath, keyPath, "before")
+
+	certs, err := newCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", newTLSConfig(certs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+	addr := listener.Addr().String()
+
+	if name := handshake(t, addr); name != "before" {
+		t.Fatalf("certificate before the swap: got %q, want %q", name, "before")
+	}
+
+	// a connection established before the reload must keep working after it
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	defer client.CloseIdleConnections()
+	get := func() {
+		t.Helper()
+		resp, err := client.Get("https://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "ok" {
+			t.Fatalf("unexpected response %q", body)
+		}
+	}
+	get()
+
+	// the modification time may not change if the files are written again
+	// within the resolution of the file system clock
+	writeSelfSignedCert(t, certPath, keyPath, "after")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, future, future)
+	os.Chtimes(keyPath, future, future)
+	if !certs.modified() {
+		t.Fatal("swapped certificate not detected as modified")
+	}
+
+	// without a handler of our own, a SIGHUP received before watch is ready
+	// would terminate the test binary
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	go certs.watch()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for name := handshake(t, addr); name != "after"; name = handshake(t, addr) {
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate after the swap: got %q, want %q", name, "after")
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		time.Sleep(50 * time.Millisecond)
+	}
+	get()
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	for _, test := range []struct{ endpoint, host, want string }{
+		{":443", "example.com", "https://example.com/items?sort=date"},
+		{":443", "example.com:80", "https://example.com/items?sort=date"},
+		{"localhost:8443", "example.com:8080", "https://example.com:8443/items?sort=date"},
+	} {
+		w := httptest.NewRecorder()
+		redirectToHTTPS(test.endpoint).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://"+test.host+"/items?sort=date", nil))
+		if got := w.Header().Get("Location"); w.Code != http.StatusMovedPermanently || got != test.want {
+			t.Errorf("%s via %s: got %d %q, want 301 %q", test.host, test.endpoint, w.Code, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token scopes. Each scope includes the ones before it.
+const (
+	SCOPE_READ  = "read"
+	SCOPE_WRITE = "write"
+	SCOPE_ADMIN = "admin"
+)
+
+var _scopeRanks = map[string]int{
+	SCOPE_READ:  1,
+	SCOPE_WRITE: 2,
+	SCOPE_ADMIN: 3,
+}
+
+// Prefix of every API token, makes tokens easy to recognize e.g. in leaked files.
+const TOKEN_PREFIX = "koi_"
+
+// How often the tokens file is checked for modifications, at most.
+const tokensCheckInterval = 2 * time.Second
+
+// APIToken is a long-lived token used by scripts and integrations. Only the SHA-256
+// hash of the secret part of the token is stored. The token itself has the form
+// koi_<ID>_<secret>, and is shown only once, when it is created.
+type APIToken struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Scope   string    `json:"scope"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+// TokenStore holds API tokens read from a JSON file. The file is modified by the
+// tokens command, and read again by the server when it changes, so that new and
+// revoked tokens take effect without restart.
+type TokenStore struct {
+	path string
+
+	lock        sync.Mutex
+	tokens      []*APIToken
+	modTime     time.Time
+	lastChecked time.Time
+}
+
+type tokensFile struct {
+	Tokens []*APIToken `json:"tokens"`
+}
+
+func newTokenStore(path string) (*TokenStore, error) {
+	store := &TokenStore{path: path}
+	if err := store.read(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Reads the file, a missing file is the same as a file without tokens.
+func (s *TokenStore) read() error {
+	s.lastChecked = time.Now()
+	fi, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.tokens, s.modTime = nil, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat tokens file: %v", err)
+	}
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read tokens file: %v", err)
+	}
+	var file tokensFile
+	if err = json.Unmarshal(content, &file); err != nil {
+		return fmt.Errorf("failed to decode tokens file %s: %v", s.path, err)
+	}
+	for _, token := range file.Tokens {
+		if _, valid := _scopeRanks[token.Scope]; !valid {
+			return fmt.Errorf("tokens file %s: token %s has invalid scope %q", s.path, token.ID, token.Scope)
+		}
+	}
+	s.tokens, s.modTime = file.Tokens, fi.ModTime()
+	return nil
+}
+
+func (s *TokenStore) write() error {
+	content, err := json.MarshalIndent(&tokensFile{s.tokens}, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(s.path, append(content, '\n'), 0600)
+}
+
+// Reads the file again if it was modified since it was last read.
+func (s *TokenStore) refresh() {
+	if time.Since(s.lastChecked) < tokensCheckInterval {
+		return
+	}
+	s.lastChecked = time.Now()
+	fi, err := os.Stat(s.path)
+	if err == nil && fi.ModTime().Equal(s.modTime) {
+		return
+	}
+	if err := s.read(); err != nil {
+		// keep the tokens that were read last time
+		traceError(_https, "%v", err)
+	}
+}
+
+// lookup returns the token if the secret is valid, or nil.
+func (s *TokenStore) lookup(secret string) *APIToken {
+	id, _, found := strings.Cut(strings.TrimPrefix(secret, TOKEN_PREFIX), "_")
+	if !strings.HasPrefix(secret, TOKEN_PREFIX) || !found {
+		return nil
+	}
+	hash := hashToken(secret)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.refresh()
+	for _, token := range s.tokens {
+		if token.ID == id && subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hash)) == 1 {
+			return token
+		}
+	}
+	return nil
+}
+
+// create adds a new token to the file, and returns the secret.
+func (s *TokenStore) create(name string, scope string) (*APIToken, string, error) {
+	if _, valid := _scopeRanks[scope]; !valid {
+		return nil, "", fmt.Errorf("invalid scope %q, expected %s, %s or %s", scope, SCOPE_READ, SCOPE_WRITE, SCOPE_ADMIN)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.read(); err != nil {
+		return nil, "", err
+	}
+	id := randomToken()[:8]
+	secret := TOKEN_PREFIX + id + "_" + randomToken()
+	token := &APIToken{
+		ID:      id,
+		Name:    name,
+		Scope:   scope,
+		Hash:    hashToken(secret),
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	s.tokens = append(s.tokens, token)
+	if err := s.write(); err != nil {
+		return nil, "", err
+	}
+	return token, secret, nil
+}
+
+func (s *TokenStore) revoke(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.read(); err != nil {
+		return err
+	}
+	for i, token := range s.tokens {
+		if token.ID == id {
+			s.tokens = append(s.tokens[:i], s.tokens[i+1:]...)
+			return s.write()
+		}
+	}
+	return fmt.Errorf("token %s not found", id)
+}
+
+func (s *TokenStore) list() ([]*APIToken, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.read(); err != nil {
+		return nil, err
+	}
+	return s.tokens, nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// scopeIncludes reports whether the granted scope includes the required one.
+func scopeIncludes(granted string, required string) bool {
+	return _scopeRanks[granted] >= _scopeRanks[required]
+}
+
+// writeFileAtomically writes content to a temporary file in the same directory,
+// and renames it to path, so that readers never see a partially written file.
+func writeFileAtomically(path string, content []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(content); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
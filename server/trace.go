@@ -1,23 +1,113 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"log"
+	"log/slog"
 	"os"
+	"strings"
 	"time"
 )
 
+// TracePrefix identifies the component of the system that traces a message.
+// It is logged as the value of the "component" attribute.
 type TracePrefix string
 
 const (
-	_control TracePrefix = "#control"
-	_env     TracePrefix = "    #env"
-	_error   TracePrefix = "  #error"
-	_warning TracePrefix = "#warning"
-	_decoder TracePrefix = "#decoder"
-	_https   TracePrefix = "  #https"
+	_control TracePrefix = "control"
+	_env     TracePrefix = "env"
+	_decoder TracePrefix = "decoder"
+	_https   TracePrefix = "https"
+	_access  TracePrefix = "access"
 )
 
-func trace(prefix TracePrefix, format string, args ...any) {
+// Log output formats.
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+// Global logger, replaced by configureLogging.
+var _logger = newLogger(os.Stdout, LOG_FORMAT_TEXT, slog.LevelInfo)
+
+// configureLogging replaces the global logger with one that writes in the given
+// format ("text" or "json"), and discards messages below level ("debug", "info",
+// "warn" or "error").
+func configureLogging(format string, level string) error {
+	minLevel, err := newLogLevel(level)
+	if err != nil {
+		return err
+	}
+	if format != LOG_FORMAT_TEXT && format != LOG_FORMAT_JSON {
+		return fmt.Errorf("invalid log format %q", format)
+	}
 	// external process control should redirect stdout to a log file
-	fmt.Fprintf(os.Stdout, "%s: %s: %s\n", time.Now().UTC().Format(time.RFC3339), prefix, fmt.Sprintf(format, args...))
+	_logger = newLogger(os.Stdout, format, minLevel)
+	return nil
+}
+
+func newLogLevel(level string) (minLevel slog.Level, err error) {
+	if err = minLevel.UnmarshalText([]byte(level)); err != nil {
+		err = fmt.Errorf("invalid log level %q", level)
+	}
+	return
+}
+
+func newLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	options := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format(time.RFC3339))
+			}
+			return a
+		},
+	}
+	if format == LOG_FORMAT_JSON {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
+}
+
+func traceAt(level slog.Level, prefix TracePrefix, format string, args ...any) {
+	if !_logger.Enabled(context.Background(), level) {
+		return
+	}
+	_logger.Log(context.Background(), level, fmt.Sprintf(format, args...), "component", string(prefix))
+}
+
+// traceAttrs traces a message with structured attributes at info level.
+func traceAttrs(prefix TracePrefix, msg string, attrs ...slog.Attr) {
+	_logger.LogAttrs(context.Background(), slog.LevelInfo, msg, append([]slog.Attr{slog.String("component", string(prefix))}, attrs...)...)
+}
+
+func trace(prefix TracePrefix, format string, args ...any) {
+	traceAt(slog.LevelInfo, prefix, format, args...)
+}
+
+func traceDebug(prefix TracePrefix, format string, args ...any) {
+	traceAt(slog.LevelDebug, prefix, format, args...)
+}
+
+func traceWarning(prefix TracePrefix, format string, args ...any) {
+	traceAt(slog.LevelWarn, prefix, format, args...)
+}
+
+func traceError(prefix TracePrefix, format string, args ...any) {
+	traceAt(slog.LevelError, prefix, format, args...)
+}
+
+// traceLogger returns a standard library logger that traces every message
+// at error level, used to redirect e.g. http.Server errors.
+func traceLogger(prefix TracePrefix) *log.Logger {
+	return log.New(traceWriter(prefix), "", 0)
+}
+
+type traceWriter TracePrefix
+
+func (t traceWriter) Write(p []byte) (int, error) {
+	traceError(TracePrefix(t), "%s", strings.TrimRight(string(p), "\n"))
+	return len(p), nil
 }
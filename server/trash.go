@@ -0,0 +1,387 @@
+package server
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Recorded in the history log as the user of automatic purges.
+const TRASH_USER = "koipond"
+
+// How often the trash is checked for items past the retention period.
+const TRASH_PURGE_INTERVAL = time.Hour
+
+// Deleted items are moved to the <trash> section of <data> in the store file,
+// as elements of <TYPE> sections like those of all other items, with the time
+// of deletion in MKEY_DELETED:
+//
+//	<trash>
+//	    <books>
+//	        <book title="..." uid="..." deleted="2024-01-02T15:04:05Z"/>
+//	    </books>
+//	</trash>
+//
+// Items in the trash are decoded into Database.trash, and are not indexed or
+// served. Their IDs are their positions in the trash.
+
+// deleteItem moves the item to the trash on behalf of the user, and assigns it
+// a persistent ID if it does not have one yet, so that it can be followed.
+func deleteItem(db *Database, id int, user string) (*Database, error) {
+	return changeStore(db, func(content []byte, items []*storeItem, _ []*storeItem) ([]byte, []*HistoryEntry, error) {
+		if id < 0 || id >= len(items) {
+			return nil, nil, errItemNotFound
+		}
+		element := items[id]
+		before := element.metadata()
+
+		now := time.Now().UTC()
+		trashed := make(map[string]string, len(before)+2)
+		for key, value := range before {
+			trashed[key] = value
+		}
+		if trashed[MKEY_UID] == "" {
+			trashed[MKEY_UID] = newUID()
+		}
+		trashed[MKEY_DELETED] = now.Format(time.RFC3339)
+
+		content, err := removeFromStore(content, []*storeItem{element}, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		if content, err = appendToTrash(content, element, orderedAttrs(element.attrs, trashed), now); err != nil {
+			return nil, nil, err
+		}
+		return content, []*HistoryEntry{{
+			Time:   now,
+			User:   user,
+			Action: HISTORY_DELETE,
+			Type:   element.typeKey,
+			ID:     id,
+			UID:    trashed[MKEY_UID],
+			Before: before,
+		}}, nil
+	})
+}
+
+// restoreItem moves the item with the ID in the trash back to the section of
+// its type on behalf of the user. The item is validated like an updated one,
+// e.g. collections may have been removed in the meantime.
+func restoreItem(db *Database, id int, user string) (*Database, error) {
+	return changeStore(db, func(content []byte, _ []*storeItem, trashed []*storeItem) ([]byte, []*HistoryEntry, error) {
+		if id < 0 || id >= len(trashed) {
+			return nil, nil, errItemNotFound
+		}
+		element := trashed[id]
+		restored := element.metadata()
+		delete(restored, MKEY_DELETED)
+		if restored[MKEY_UID] == "" {
+			restored[MKEY_UID] = newUID()
+		}
+		if err := db.validateItem(element.typeKey, restored); err != nil {
+			return nil, nil, errInvalidItem{err}
+		}
+
+		now := time.Now().UTC()
+		content, err := removeFromStore(content, []*storeItem{element}, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		content, err = appendToStore(content, element.typeKey, [][]xml.Attr{orderedAttrs(element.attrs, restored)}, now)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// the item is appended to its section, which is not necessarily the last one
+		items, _, err := scanItems(content, db.enabledTypes)
+		if err != nil {
+			return nil, nil, err
+		}
+		newID := -1
+		for i, item := range items {
+			if item.metadata()[MKEY_UID] == restored[MKEY_UID] {
+				newID = i
+			}
+		}
+		return content, []*HistoryEntry{{
+			Time:   now,
+			User:   user,
+			Action: HISTORY_RESTORE,
+			Type:   element.typeKey,
+			ID:     newID,
+			UID:    restored[MKEY_UID],
+			After:  restored,
+		}}, nil
+	})
+}
+
+// purgeItems permanently removes the items in the trash for which purge returns
+// true on behalf of the user. If there are none, the store file is not written.
+func purgeItems(db *Database, user string, purge func(trashed *Item) bool) (*Database, int, error) {
+	purged := 0
+	for _, item := range db.trash {
+		if purge(item) {
+			purged++
+		}
+	}
+	if purged == 0 {
+		return db, 0, nil
+	}
+
+	reloaded, err := changeStore(db, func(content []byte, _ []*storeItem, trashed []*storeItem) ([]byte, []*HistoryEntry, error) {
+		// the trash of the Database matches the store file, see changeStore
+		if len(trashed) != len(db.trash) {
+			return nil, nil, errStoreChanged
+		}
+		now := time.Now().UTC()
+		removed := []*storeItem{}
+		entries := []*HistoryEntry{}
+		for id, element := range trashed {
+			if !purge(db.trash[id]) {
+				continue
+			}
+			metadata := element.metadata()
+			removed = append(removed, element)
+			entries = append(entries, &HistoryEntry{
+				Time:   now,
+				User:   user,
+				Action: HISTORY_PURGE,
+				Type:   element.typeKey,
+				ID:     -1,
+				UID:    metadata[MKEY_UID],
+				Before: metadata,
+			})
+		}
+		content, err := removeFromStore(content, removed, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		return content, entries, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return reloaded, purged, nil
+}
+
+// deletedAt returns the time at which the item in the trash was deleted, or
+// the zero time if it is not known, e.g. the item was moved there by hand.
+func deletedAt(item *Item) time.Time {
+	deleted, err := time.Parse(time.RFC3339, item.Metadata[MKEY_DELETED])
+	if err != nil {
+		return time.Time{}
+	}
+	return deleted
+}
+
+// expired reports whether the item in the trash is past the retention period.
+// Items deleted at an unknown time never expire.
+func expired(item *Item, retention time.Duration, now time.Time) bool {
+	deleted := deletedAt(item)
+	return retention > 0 && !deleted.IsZero() && now.Sub(deleted) > retention
+}
+
+// purgeTrash periodically purges items that have been in the trash longer than
+// the retention period, until stop is closed. If the store file is changed in
+// the meantime, they are purged on the next check, after the database is reloaded.
+func purgeTrash(stop <-chan struct{}) {
+	retention := time.Duration(_config.Trash.Retention)
+	purgeExpired := func() {
+		_, purged, err := purgeItems(currentDatabase(), TRASH_USER, func(item *Item) bool {
+			return expired(item, retention, time.Now())
+		})
+		if err != nil {
+			traceError(_decoder, "trash: %v", err)
+			return
+		}
+		if purged > 0 {
+			trace(_decoder, "trash: purged %d items deleted more than %v ago", purged, retention)
+		}
+	}
+
+	ticker := time.NewTicker(TRASH_PURGE_INTERVAL)
+	defer ticker.Stop()
+	for purgeExpired(); ; purgeExpired() {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// TrashList holds items in the trash grouped by type label, in the order in
+// which they were deleted.
+//
+// TrashList implements DataObjectInterface.
+type TrashList struct {
+	CommonBaseObject
+
+	Types map[string][]*TrashedItem
+}
+
+// TrashedItem is an item in the trash, as rendered on the trash page. The
+// revision is submitted with the forms of the item, see checkFormRevision.
+type TrashedItem struct {
+	ID       int
+	Label    string
+	Revision string
+	Deleted  string
+	// empty if the item is never purged automatically
+	Expires string
+}
+
+// Ref implements DataObjectInterface.
+func (t *TrashList) Ref() any {
+	return t
+}
+
+// HideTags implements DataObjectInterface.
+func (*TrashList) HideTags() bool {
+	return true
+}
+
+func newTrashList(db *Database, retention time.Duration) *TrashList {
+	list := &TrashList{Types: map[string][]*TrashedItem{}}
+	for _, item := range db.trash {
+		trashed := &TrashedItem{ID: item.ID, Label: item.Label, Revision: item.Revision, Deleted: "unknown"}
+		if deleted := deletedAt(item); !deleted.IsZero() {
+			trashed.Deleted = deleted.Local().Format("2006-01-02 15:04:05")
+			if retention > 0 {
+				trashed.Expires = deleted.Add(retention).Local().Format("2006-01-02 15:04:05")
+			}
+		}
+		label := GroupTypeLabel(item.Type)
+		list.Types[label] = append(list.Types[label], trashed)
+	}
+	return list
+}
+
+// trashedItem returns the item in the trash with the ID in the path, or nil.
+func trashedItem(db *Database, r *http.Request) *Item {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 0 || id >= len(db.trash) {
+		return nil
+	}
+	return db.trash[id]
+}
+
+// respondToChange responds to a failed change of the store file, or redirects to next.
+func respondToChange(w http.ResponseWriter, r *http.Request, err error, next string) {
+	switch {
+	case errors.Is(err, errStoreChanged):
+		http.Error(w, "The store file was changed in the meantime, reload the page and try again.", http.StatusConflict)
+	case errors.Is(err, errItemNotFound):
+		renderNotFound(w, "Item not found.")
+	case errors.As(err, &errInvalidItem{}):
+		http.Error(w, fmt.Sprintf("The item cannot be restored: %v.", err), http.StatusUnprocessableEntity)
+	case err != nil:
+		traceError(_https, "change store: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	}
+}
+
+// renderItemDelete handles /items/{id}/delete, the confirmation of a deletion.
+func renderItemDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	item := currentDatabase().view(AUDIENCE_AUTHENTICATED).singleItem(id)
+	if err != nil || item == nil {
+		renderNotFound(w, "Item not found.")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	render(
+		w,
+		http.StatusOK,
+		HTMLPage{
+			Key:        "@delete",
+			Supertitle: TypeLabel(item.Type),
+			Title:      item.Label,
+			CSRFToken:  csrfToken(w, r),
+			Admin:      true,
+			Data:       item,
+		},
+	)
+}
+
+// handleItemDelete handles moving of an item to the trash, unless it was
+// changed since the confirmation was rendered.
+func handleItemDelete(w http.ResponseWriter, r *http.Request) {
+	db := currentDatabase()
+	id, err := strconv.Atoi(r.PathValue("id"))
+	item := db.view(AUDIENCE_AUTHENTICATED).singleItem(id)
+	if err != nil || item == nil {
+		renderNotFound(w, "Item not found.")
+		return
+	}
+	if !checkFormRevision(w, r, db, item) {
+		return
+	}
+	_, err = deleteItem(db, id, requestUser(r))
+	if err == nil {
+		trace(_https, "user %q deleted item %d", requestUser(r), id)
+	}
+	respondToChange(w, r, err, "/trash")
+}
+
+// renderTrash handles /trash. The page is not cached, since it embeds the CSRF
+// token used by restore and purge forms.
+func renderTrash(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	render(
+		w,
+		http.StatusOK,
+		HTMLPage{
+			Key:        "@trash",
+			Supertitle: "Deleted items",
+			Title:      "Trash",
+			CSRFToken:  csrfToken(w, r),
+			Admin:      true,
+			Data:       newTrashList(currentDatabase(), time.Duration(_config.Trash.Retention)),
+		},
+	)
+}
+
+// handleTrashRestore handles restoring of an item in the trash, unless the
+// trash changed since the page was rendered, and the ID refers to another item.
+func handleTrashRestore(w http.ResponseWriter, r *http.Request) {
+	db := currentDatabase()
+	item := trashedItem(db, r)
+	if item == nil {
+		renderNotFound(w, "Item not found.")
+		return
+	}
+	if !checkFormRevision(w, r, db, item) {
+		return
+	}
+	_, err := restoreItem(db, item.ID, requestUser(r))
+	if err == nil {
+		trace(_https, "user %q restored item %d from the trash", requestUser(r), item.ID)
+	}
+	respondToChange(w, r, err, "/trash")
+}
+
+// handleTrashPurge handles permanent removal of an item in the trash, unless
+// the trash changed since the page was rendered, and the ID refers to another item.
+func handleTrashPurge(w http.ResponseWriter, r *http.Request) {
+	db := currentDatabase()
+	item := trashedItem(db, r)
+	if item == nil {
+		renderNotFound(w, "Item not found.")
+		return
+	}
+	if !checkFormRevision(w, r, db, item) {
+		return
+	}
+	_, _, err := purgeItems(db, requestUser(r), func(trashed *Item) bool { return trashed == item })
+	if err == nil {
+		trace(_https, "user %q purged item %d from the trash", requestUser(r), item.ID)
+	}
+	respondToChange(w, r, err, "/trash")
+}
@@ -82,3 +82,15 @@ func IsValidItemAliasForType(key string, typeKey string) bool {
 	}
 	return false
 }
+
+// ItemAlias returns the keyword used for single items of the type
+// when they are written to the database, e.g. "book" for "books" type.
+func ItemAlias(typeKey string) string {
+	switch typeKey {
+	case "books":
+		return "book"
+	case "games":
+		return "game"
+	}
+	return "item"
+}
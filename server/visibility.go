@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Visibility determines who can see an item or a collection.
+type Visibility int
+
+const (
+	// Listed in catalogues and accessible to everyone.
+	VISIBILITY_PUBLIC Visibility = iota
+	// Accessible to everyone with a direct link, but listed only to authenticated users.
+	VISIBILITY_UNLISTED
+	// Listed and accessible only to authenticated users.
+	VISIBILITY_PRIVATE
+)
+
+// Audience is the group of users a response is prepared for.
+type Audience int
+
+const (
+	AUDIENCE_PUBLIC Audience = iota
+	AUDIENCE_AUTHENTICATED
+
+	audienceCount = 2
+)
+
+var _visibilityNames = map[string]Visibility{
+	"public":   VISIBILITY_PUBLIC,
+	"unlisted": VISIBILITY_UNLISTED,
+	"private":  VISIBILITY_PRIVATE,
+}
+
+func parseVisibility(s string) (Visibility, error) {
+	if s == "" {
+		return VISIBILITY_PUBLIC, nil
+	}
+	if v, found := _visibilityNames[s]; found {
+		return v, nil
+	}
+	return VISIBILITY_PRIVATE, fmt.Errorf("invalid visibility %q", s)
+}
+
+func (v Visibility) String() string {
+	for name, value := range _visibilityNames {
+		if value == v {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// listedFor reports whether the object is included in catalogues, tag counts and listings.
+func (v Visibility) listedFor(a Audience) bool {
+	return v == VISIBILITY_PUBLIC || a == AUDIENCE_AUTHENTICATED
+}
+
+// accessibleTo reports whether the object can be accessed directly.
+func (v Visibility) accessibleTo(a Audience) bool {
+	return v != VISIBILITY_PRIVATE || a == AUDIENCE_AUTHENTICATED
+}
+
+// audienceOf returns the audience the request belongs to. Users, and tokens of
+// every scope, belong to the authenticated audience: tokens are created by the
+// owner of the store, and the scope limits what they can change, not what they
+// can read. Only administrators get links to administration pages, see isAdmin.
+func audienceOf(r *http.Request) Audience {
+	if requestPrincipal(r) != nil {
+		return AUDIENCE_AUTHENTICATED
+	}
+	return AUDIENCE_PUBLIC
+}
@@ -19,19 +19,32 @@ const (
 	XMLATTR_CREATED      = "created"
 	XMLATTR_LASTMODIFIED = "lastModified"
 	XMLNODE_DATA         = "data"
+	XMLNODE_TRASH        = "trash" // reserved, holds <TYPE> sections of deleted items
 	XMLNODE_METADATA     = "metadata"
 	XMLNODE_KOITYPES     = "koitypes"
 	XMLATTR_ENABLED      = "enabled"
 	XMLNODE_COLLECTIONS  = "collections"
 	XMLNODE_COLLECTION   = "collection"
 	XMLATTR_HIDDEN       = "hidden"
+	XMLATTR_VISIBILITY   = "visibility"
 )
 
-func DecodeDatabase(r io.Reader) error {
+// DecodeDatabase decodes the XML byte stream read from r into a new Database.
+func DecodeDatabase(r io.Reader) (*Database, error) {
 	if r == nil {
-		return ErrNilReader
+		return nil, ErrNilReader
 	}
 
+	db := newDatabase()
+	if err := db.decode(r); err != nil {
+		return nil, err
+	}
+	db.precompute()
+
+	return db, nil
+}
+
+func (db *Database) decode(r io.Reader) error {
 	decoder := xml.NewDecoder(r)
 
 	// <koidatabase ... >
@@ -44,12 +57,12 @@ func DecodeDatabase(r io.Reader) error {
 	if ts, err := time.Parse(time.DateOnly, created); err != nil {
 		return fmt.Errorf("failed to detect or decode attribute <%s %s>: %w", XMLNODE_KOIDATABASE, XMLATTR_CREATED, err)
 	} else {
-		_database.created = ts
+		db.created = ts
 	}
 	if ts, err := time.Parse(time.DateOnly, lastModified); err != nil {
 		return fmt.Errorf("failed to detect or decode attribute <%s %s>: %w", XMLNODE_KOIDATABASE, XMLATTR_LASTMODIFIED, err)
 	} else {
-		_database.lastModified = ts
+		db.lastModified = ts
 	}
 	trace(_decoder, "created=%s, lastModified=%s", created, lastModified)
 
@@ -66,7 +79,7 @@ func DecodeDatabase(r io.Reader) error {
 		return fmt.Errorf("failed to decode attribute <%s %s>: invalid typelist format", XMLNODE_KOITYPES, XMLATTR_ENABLED)
 	} else {
 		for _, t := range enabledTypes {
-			_database.enabledTypes.Insert(t)
+			db.enabledTypes.Insert(t)
 		}
 		trace(_decoder, "enabled types: %s", strings.Join(enabledTypes, ", "))
 	}
@@ -88,11 +101,11 @@ func DecodeDatabase(r io.Reader) error {
 			if !isValidDefaultMetadataValueKeyRE(metadata.Key) {
 				return fmt.Errorf("failed to decode <%s>: invalid attribute format", XMLNODE_METADATA)
 			}
-			_database.defaults[metadata.Key] = metadata.DefaultValue
-			trace(_decoder, "predefined default %s:%q", metadata.Key, metadata.DefaultValue)
+			db.defaults[metadata.Key] = metadata.DefaultValue
+			traceDebug(_decoder, "predefined default %s:%q", metadata.Key, metadata.DefaultValue)
 		} else {
 			// </koitypes>
-			trace(_decoder, "XML node <%s> decoding completed", XMLNODE_KOITYPES)
+			traceDebug(_decoder, "XML node <%s> decoding completed", XMLNODE_KOITYPES)
 			break
 		}
 	}
@@ -102,16 +115,13 @@ func DecodeDatabase(r io.Reader) error {
 	if err != nil {
 		return fmt.Errorf("failed to detect <%s>: %w", XMLNODE_COLLECTIONS, err)
 	}
+	var hiddenCollections []string
 	hiddenCollectionsStr, found := findAttribute(currentNode, XMLATTR_HIDDEN)
 	if found {
-		if hiddenCollections := splitJoinedWords(hiddenCollectionsStr); hiddenCollections == nil {
+		if hiddenCollections = splitJoinedWords(hiddenCollectionsStr); hiddenCollections == nil {
 			return fmt.Errorf("failed to decode attribute <%s %s>: invalid keylist format", XMLNODE_COLLECTIONS, XMLATTR_HIDDEN)
-		} else {
-			for _, c := range hiddenCollections {
-				_database.hiddenCollections.Insert(c)
-			}
-			trace(_decoder, "hidden collections: %s", strings.Join(hiddenCollections, ", "))
 		}
+		trace(_decoder, "hidden collections: %s", strings.Join(hiddenCollections, ", "))
 	}
 
 	// <collections> <collection ... /> 0..N </collections>
@@ -122,8 +132,9 @@ func DecodeDatabase(r io.Reader) error {
 		if currentNode != nil {
 			// <collection ...>
 			var collection = &struct {
-				Key  string `xml:"key,attr"`
-				Name string `xml:"name,attr"`
+				Key        string `xml:"key,attr"`
+				Name       string `xml:"name,attr"`
+				Visibility string `xml:"visibility,attr"`
 			}{}
 			if err = decoder.DecodeElement(collection, currentNode); err != nil {
 				return fmt.Errorf("failed to decode <%s>: %w", XMLNODE_COLLECTION, err)
@@ -131,14 +142,28 @@ func DecodeDatabase(r io.Reader) error {
 			if !isValidCollectionKey(collection.Key) {
 				return fmt.Errorf("failed to decode <%s>: invalid attribute format", XMLNODE_COLLECTION)
 			}
-			_database.declaredCollections[collection.Key] = collection.Name
-			trace(_decoder, "declared collection %s:%q", collection.Key, collection.Name)
+			db.declaredCollections[collection.Key] = collection.Name
+			if collection.Visibility != "" {
+				visibility, err := parseVisibility(collection.Visibility)
+				if err != nil {
+					return fmt.Errorf("failed to decode attribute <%s %s>: %w", XMLNODE_COLLECTION, XMLATTR_VISIBILITY, err)
+				}
+				db.collectionVisibility[collection.Key] = visibility
+			}
+			traceDebug(_decoder, "declared collection %s:%q", collection.Key, collection.Name)
 		} else {
 			// </collections>
-			trace(_decoder, "XML node <%s> decoding completed", XMLNODE_COLLECTIONS)
+			traceDebug(_decoder, "XML node <%s> decoding completed", XMLNODE_COLLECTIONS)
 			break
 		}
 	}
+	// hidden collections are private, even if a <collection> sets another visibility
+	for _, c := range hiddenCollections {
+		if visibility, set := db.collectionVisibility[c]; set && visibility != VISIBILITY_PRIVATE {
+			traceWarning(_decoder, "collection %s is hidden, ignoring <%s %s=%q>", c, XMLNODE_COLLECTION, XMLATTR_VISIBILITY, visibility)
+		}
+		db.collectionVisibility[c] = VISIBILITY_PRIVATE
+	}
 
 	// <data>
 	if _, err = expectStart(decoder, XMLNODE_DATA); err != nil {
@@ -152,55 +177,31 @@ func DecodeDatabase(r io.Reader) error {
 		if currentNode != nil {
 			// <TYPE>...</TYPE>
 			typeKey := currentNode.Name.Local
+			if typeKey == XMLNODE_TRASH {
+				if err = db.decodeTrash(decoder); err != nil {
+					return err
+				}
+				continue
+			}
 			if !isValidWord(typeKey) {
-				trace(_warning, "skipping XML node <%s> entirely: invalid typename format", typeKey)
+				traceWarning(_decoder, "skipping XML node <%s> entirely: invalid typename format", typeKey)
 				decoder.Skip()
 				continue
 			}
-			if !_database.enabledTypes.Contains(typeKey) {
-				trace(_decoder, "skipping XML node <%s> entirely: type is not enabled", typeKey)
+			if !db.enabledTypes.Contains(typeKey) {
+				traceDebug(_decoder, "skipping XML node <%s> entirely: type is not enabled", typeKey)
 				decoder.Skip()
 				continue
 			}
-			trace(_decoder, "proceeding to decode XML node <%s> and all items defined for this type", typeKey)
-			itemCnt := 0
-			// <TYPE> <ITEM>...</ITEM> 0..N </TYPE>
-			for {
-				if currentNode, err = anyStartOrEnd(decoder, typeKey); err != nil {
-					return fmt.Errorf("failed to detect <ITEM> or </%s>: %w", typeKey, err)
-				}
-				if currentNode != nil {
-					// <ITEM>
-					itemKey := currentNode.Name.Local
-					if !IsValidItemAliasForType(itemKey, typeKey) {
-						trace(_warning, "skipping XML node <%s> entirely: unknown keyword for items of type %q", itemKey, typeKey)
-						decoder.Skip()
-						continue
-					}
-					itemMetadata := make(map[string]string)
-					for _, attr := range currentNode.Attr {
-						if isValidMetadataKey(attr.Name.Local) {
-							itemMetadata[attr.Name.Local] = attr.Value
-						} else {
-							trace(_warning, "skipping attribute <%s %s>: invalid metadata key format", itemKey, attr.Name.Local)
-						}
-					}
-					if item := _database.add(typeKey, itemMetadata); item == nil {
-						trace(_warning, "failed to add item of type %q to the database, check item metadata", typeKey)
-						decoder.Skip()
-						continue
-					}
-					itemCnt++
-					decoder.Skip()
-				} else {
-					// </TYPE>
-					trace(_decoder, "decoded %d items of type %q", itemCnt, typeKey)
-					break
-				}
+			traceDebug(_decoder, "proceeding to decode XML node <%s> and all items defined for this type", typeKey)
+			itemCnt, err := decodeItems(decoder, typeKey, db.add)
+			if err != nil {
+				return err
 			}
+			trace(_decoder, "decoded %d items of type %q", itemCnt, typeKey)
 		} else {
 			// </data>
-			trace(_decoder, "XML node <%s> decoding completed", XMLNODE_DATA)
+			traceDebug(_decoder, "XML node <%s> decoding completed", XMLNODE_DATA)
 			break
 		}
 	}
@@ -213,6 +214,72 @@ func DecodeDatabase(r io.Reader) error {
 	return nil
 }
 
+// decodeTrash decodes <trash> <TYPE>...</TYPE> 0..N </trash>, the sections of
+// deleted items, which are kept apart from all other items.
+func (db *Database) decodeTrash(decoder *xml.Decoder) error {
+	trashedCnt := 0
+	for {
+		currentNode, err := anyStartOrEnd(decoder, XMLNODE_TRASH)
+		if err != nil {
+			return fmt.Errorf("failed to detect <TYPE> or </%s>: %w", XMLNODE_TRASH, err)
+		}
+		if currentNode == nil {
+			// </trash>
+			trace(_decoder, "decoded %d items in the trash", trashedCnt)
+			return nil
+		}
+		typeKey := currentNode.Name.Local
+		if !isValidWord(typeKey) || !db.enabledTypes.Contains(typeKey) {
+			traceDebug(_decoder, "skipping XML node <%s> in <%s> entirely: type is invalid or not enabled", typeKey, XMLNODE_TRASH)
+			decoder.Skip()
+			continue
+		}
+		itemCnt, err := decodeItems(decoder, typeKey, db.addTrashed)
+		if err != nil {
+			return err
+		}
+		trashedCnt += itemCnt
+	}
+}
+
+// decodeItems decodes <TYPE> <ITEM>...</ITEM> 0..N </TYPE> after <TYPE>, and passes
+// the metadata of every item to add. It returns the number of added items.
+func decodeItems(decoder *xml.Decoder, typeKey string, add func(typeKey string, metadata map[string]string) *Item) (int, error) {
+	itemCnt := 0
+	for {
+		currentNode, err := anyStartOrEnd(decoder, typeKey)
+		if err != nil {
+			return 0, fmt.Errorf("failed to detect <ITEM> or </%s>: %w", typeKey, err)
+		}
+		if currentNode == nil {
+			// </TYPE>
+			return itemCnt, nil
+		}
+		// <ITEM>
+		itemKey := currentNode.Name.Local
+		if !IsValidItemAliasForType(itemKey, typeKey) {
+			traceWarning(_decoder, "skipping XML node <%s> entirely: unknown keyword for items of type %q", itemKey, typeKey)
+			decoder.Skip()
+			continue
+		}
+		itemMetadata := make(map[string]string)
+		for _, attr := range currentNode.Attr {
+			if isValidMetadataKey(attr.Name.Local) {
+				itemMetadata[attr.Name.Local] = attr.Value
+			} else {
+				traceWarning(_decoder, "skipping attribute <%s %s>: invalid metadata key format", itemKey, attr.Name.Local)
+			}
+		}
+		if item := add(typeKey, itemMetadata); item == nil {
+			traceWarning(_decoder, "failed to add item of type %q to the database, check item metadata", typeKey)
+			decoder.Skip()
+			continue
+		}
+		itemCnt++
+		decoder.Skip()
+	}
+}
+
 func expectStart(decoder *xml.Decoder, name string) (*xml.StartElement, error) {
 	tok, err := nextToken(decoder)
 	if err != nil {